@@ -0,0 +1,59 @@
+package blob
+
+import (
+	"bufio"
+	"io"
+)
+
+// Content-defined chunking with a gear hash. A chunk ends where the high
+// bits of the rolling hash (which depend on the last 64 bytes) are zero, so
+// an insertion only changes the chunks around it, and the rest are
+// deduplicated.
+const (
+	CHUNK_MIN  = 2 << 10
+	CHUNK_BITS = 13 // 8K on average
+	CHUNK_MAX  = 64 << 10
+)
+
+// random numbers for each byte value, fixed so that the chunks are stable
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x646266732d626c62) // splitmix64
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+type chunker struct {
+	in  *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{in: bufio.NewReaderSize(r, CHUNK_MAX), buf: make([]byte, 0, CHUNK_MAX)}
+}
+
+// the next chunk, only valid until the next call. io.EOF at the end.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	hash := uint64(0)
+	for len(c.buf) < CHUNK_MAX {
+		b, err := c.in.ReadByte()
+		if err == io.EOF && len(c.buf) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gear[b]
+		if len(c.buf) >= CHUNK_MIN && hash>>(64-CHUNK_BITS) == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
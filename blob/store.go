@@ -0,0 +1,415 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"dbfs/btree"
+)
+
+// A blob is a list of chunks, and a chunk is stored once per content.
+// The buckets:
+//   - blobs:   | name length 2B | name | chunk index 4B | => | hash 32B | size 4B |
+//     and a header at the index 0xFFFFFFFF => | blob size 8B |
+//   - chunks:  hash => | refcount 8B | size 4B |
+//   - data:    | hash | part 2B | => bytes, a chunk is split to fit in values
+//   - garbage: hash => empty, the chunks whose refcount dropped to 0
+//
+// Unreferenced chunks are kept until a GC, which deletes them in batches of
+// normal transactions. A chunk that is referenced again before that is kept.
+const (
+	BUCKET_BLOBS   = "blob.blobs"
+	BUCKET_CHUNKS  = "blob.chunks"
+	BUCKET_DATA    = "blob.data"
+	BUCKET_GARBAGE = "blob.garbage"
+)
+
+// the buckets of a txn in order
+var txnBuckets = []string{BUCKET_BLOBS, BUCKET_CHUNKS, BUCKET_DATA, BUCKET_GARBAGE}
+
+const (
+	HASH_SIZE  = sha256.Size
+	PART_SIZE  = 2000
+	MAX_NAME   = btree.BTREE_MAX_KEY_SIZE - 6
+	GC_BATCH   = 256 // chunks per transaction
+	HEADER_IDX = ^uint32(0)
+)
+
+var (
+	ErrNotFound = errors.New("blob not found")
+	ErrName     = errors.New("bad blob name")
+)
+
+type Hash [HASH_SIZE]byte
+
+// a chunk of a blob
+type Chunk struct {
+	Hash Hash
+	Size int
+}
+
+// the result of a Put
+type PutStats struct {
+	Size      int64
+	Chunks    int
+	NewChunks int // not deduplicated
+	NewBytes  int64
+}
+
+type Store struct {
+	db *btree.KV
+}
+
+func New(db *btree.KV) *Store {
+	return &Store{db: db}
+}
+
+// the buckets in a KV transaction
+type txn struct {
+	blobs   *btree.Bucket
+	chunks  *btree.Bucket
+	data    *btree.Bucket
+	garbage *btree.Bucket
+}
+
+// run `fn` in a transaction, which is committed if it returns nil
+func (s *Store) update(fn func(t *txn) error) error {
+	return s.db.WithBuckets(txnBuckets, true, func(b []*btree.Bucket) error {
+		return fn(&txn{blobs: b[0], chunks: b[1], data: b[2], garbage: b[3]})
+	})
+}
+
+// run `fn` in a transaction that is always rolled back
+func (s *Store) view(fn func(t *txn) error) error {
+	return s.db.WithBuckets(txnBuckets, false, func(b []*btree.Bucket) error {
+		return fn(&txn{blobs: b[0], chunks: b[1], data: b[2], garbage: b[3]})
+	})
+}
+
+func checkName(name string) error {
+	if len(name) == 0 || len(name) > MAX_NAME {
+		return ErrName
+	}
+	return nil
+}
+
+func manifestPrefix(name string) []byte {
+	key := binary.BigEndian.AppendUint16(nil, uint16(len(name)))
+	return append(key, name...)
+}
+
+func manifestKey(name string, idx uint32) []byte {
+	return binary.BigEndian.AppendUint32(manifestPrefix(name), idx)
+}
+
+func partKey(hash Hash, part uint16) []byte {
+	return binary.BigEndian.AppendUint16(hash[:], part)
+}
+
+// the chunks of a blob in order
+func (t *txn) manifest(name string) ([]Chunk, bool, error) {
+	prefix := manifestPrefix(name)
+	chunks := []Chunk{}
+	found := false
+	err := t.blobs.Scan(prefix, func(key []byte, val []byte) bool {
+		if len(key) != len(prefix)+4 || string(key[:len(prefix)]) != string(prefix) {
+			return false
+		}
+		if binary.BigEndian.Uint32(key[len(prefix):]) == HEADER_IDX {
+			found = true
+			return false
+		}
+		chunk := Chunk{Size: int(binary.LittleEndian.Uint32(val[HASH_SIZE:]))}
+		copy(chunk.Hash[:], val)
+		chunks = append(chunks, chunk)
+		return true
+	})
+	return chunks, found, err
+}
+
+// add a reference to a chunk, the data is loaded and stored if it's new
+func (t *txn) ref(chunk Chunk, load func() ([]byte, error)) (bool, error) {
+	val, ok, err := t.chunks.Get(chunk.Hash[:])
+	if err != nil {
+		return false, err
+	}
+	refs := uint64(0)
+	if ok {
+		refs = binary.LittleEndian.Uint64(val)
+	} else {
+		data, err := load()
+		if err != nil {
+			return false, err
+		}
+		for part := 0; part*PART_SIZE < len(data); part++ {
+			end := min(len(data), (part+1)*PART_SIZE)
+			if err := t.data.Set(partKey(chunk.Hash, uint16(part)), data[part*PART_SIZE:end]); err != nil {
+				return false, err
+			}
+		}
+	}
+	return !ok, t.setRefs(chunk.Hash, refs+1, chunk.Size)
+}
+
+// drop a reference to a chunk, an unreferenced chunk becomes garbage
+func (t *txn) unref(chunk Chunk) error {
+	val, ok, err := t.chunks.Get(chunk.Hash[:])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	refs := binary.LittleEndian.Uint64(val) - 1
+	if refs == 0 {
+		if err := t.garbage.Set(chunk.Hash[:], nil); err != nil {
+			return err
+		}
+	}
+	return t.setRefs(chunk.Hash, refs, chunk.Size)
+}
+
+func (t *txn) setRefs(hash Hash, refs uint64, size int) error {
+	val := binary.LittleEndian.AppendUint64(nil, refs)
+	val = binary.LittleEndian.AppendUint32(val, uint32(size))
+	return t.chunks.Set(hash[:], val)
+}
+
+// remove the manifest of a blob and drop its references
+func (t *txn) remove(name string) (bool, error) {
+	chunks, found, err := t.manifest(name)
+	if err != nil || !found {
+		return false, err
+	}
+	for i, chunk := range chunks {
+		if _, err := t.blobs.Del(manifestKey(name, uint32(i))); err != nil {
+			return false, err
+		}
+		if err := t.unref(chunk); err != nil {
+			return false, err
+		}
+	}
+	_, err = t.blobs.Del(manifestKey(name, HEADER_IDX))
+	return true, err
+}
+
+// the chunks of a blob, read before the transaction so that a slow reader
+// doesn't block the KV. the data is kept in a temporary file.
+type spool struct {
+	file   *os.File
+	chunks []Chunk
+	offs   []int64
+	buf    []byte
+}
+
+func newSpool(r io.Reader) (*spool, error) {
+	file, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{file: file, buf: make([]byte, CHUNK_MAX)}
+	chunker := newChunker(r)
+	for off := int64(0); ; {
+		data, err := chunker.next()
+		if err == io.EOF {
+			return sp, nil
+		}
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			sp.close()
+			return nil, err
+		}
+		sp.chunks = append(sp.chunks, Chunk{Hash: sha256.Sum256(data), Size: len(data)})
+		sp.offs = append(sp.offs, off)
+		off += int64(len(data))
+	}
+}
+
+// the data of the `i`th chunk, only valid until the next call
+func (sp *spool) data(i int) ([]byte, error) {
+	data := sp.buf[:sp.chunks[i].Size]
+	_, err := sp.file.ReadAt(data, sp.offs[i])
+	return data, err
+}
+
+func (sp *spool) close() {
+	sp.file.Close()
+	os.Remove(sp.file.Name())
+}
+
+// store a blob atomically, replacing an existing one
+func (s *Store) Put(name string, r io.Reader) (PutStats, error) {
+	stats := PutStats{}
+	if err := checkName(name); err != nil {
+		return stats, err
+	}
+	sp, err := newSpool(r)
+	if err != nil {
+		return stats, err
+	}
+	defer sp.close()
+	err = s.update(func(t *txn) error {
+		stats = PutStats{}
+		old, _, err := t.manifest(name)
+		if err != nil {
+			return err
+		}
+		// the new chunks are referenced before the old ones are dropped
+		for i, chunk := range sp.chunks {
+			added, err := t.ref(chunk, func() ([]byte, error) { return sp.data(i) })
+			if err != nil {
+				return err
+			}
+			val := append(chunk.Hash[:], binary.LittleEndian.AppendUint32(nil, uint32(chunk.Size))...)
+			if err := t.blobs.Set(manifestKey(name, uint32(i)), val); err != nil {
+				return err
+			}
+			stats.Size += int64(chunk.Size)
+			stats.Chunks++
+			if added {
+				stats.NewChunks++
+				stats.NewBytes += int64(chunk.Size)
+			}
+		}
+		for i, chunk := range old {
+			if i >= stats.Chunks {
+				if _, err := t.blobs.Del(manifestKey(name, uint32(i))); err != nil {
+					return err
+				}
+			}
+			if err := t.unref(chunk); err != nil {
+				return err
+			}
+		}
+		size := binary.LittleEndian.AppendUint64(nil, uint64(stats.Size))
+		return t.blobs.Set(manifestKey(name, HEADER_IDX), size)
+	})
+	return stats, err
+}
+
+// the chunk hashes of a blob
+func (s *Store) Chunks(name string) ([]Chunk, error) {
+	var chunks []Chunk
+	err := s.view(func(t *txn) error {
+		var found bool
+		var err error
+		chunks, found, err = t.manifest(name)
+		if err == nil && !found {
+			err = ErrNotFound
+		}
+		return err
+	})
+	return chunks, err
+}
+
+// write the content of a blob, which is read in a single transaction
+func (s *Store) Get(name string, w io.Writer) (int64, error) {
+	written := int64(0)
+	err := s.view(func(t *txn) error {
+		chunks, found, err := t.manifest(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		for _, chunk := range chunks {
+			for part := 0; part*PART_SIZE < chunk.Size; part++ {
+				data, ok, err := t.data.Get(partKey(chunk.Hash, uint16(part)))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errors.New("missing chunk data")
+				}
+				n, err := w.Write(data)
+				written += int64(n)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return written, err
+}
+
+func (s *Store) Delete(name string) error {
+	return s.update(func(t *txn) error {
+		ok, err := t.remove(name)
+		if err == nil && !ok {
+			err = ErrNotFound
+		}
+		return err
+	})
+}
+
+// call `fn` for each blob name in order until it returns false
+func (s *Store) List(fn func(name string) bool) error {
+	return s.view(func(t *txn) error {
+		return t.blobs.Scan(nil, func(key []byte, _ []byte) bool {
+			n := int(binary.BigEndian.Uint16(key))
+			if binary.BigEndian.Uint32(key[2+n:]) != HEADER_IDX {
+				return true // the chunks before the header
+			}
+			return fn(string(key[2 : 2+n]))
+		})
+	})
+}
+
+// delete the unreferenced chunks, returns the number of deleted chunks
+func (s *Store) GC() (int, error) {
+	total := 0
+	for {
+		n := 0
+		err := s.update(func(t *txn) error {
+			n = 0
+			hashes := []Hash{}
+			err := t.garbage.Scan(nil, func(key []byte, _ []byte) bool {
+				hashes = append(hashes, Hash(key))
+				return len(hashes) < GC_BATCH
+			})
+			if err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				if _, err := t.garbage.Del(hash[:]); err != nil {
+					return err
+				}
+				val, ok, err := t.chunks.Get(hash[:])
+				if err != nil {
+					return err
+				}
+				if !ok || binary.LittleEndian.Uint64(val) > 0 {
+					continue // referenced again
+				}
+				size := int(binary.LittleEndian.Uint32(val[8:]))
+				for part := 0; part*PART_SIZE < size; part++ {
+					if _, err := t.data.Del(partKey(hash, uint16(part))); err != nil {
+						return err
+					}
+				}
+				if _, err := t.chunks.Del(hash[:]); err != nil {
+					return err
+				}
+				n++
+			}
+			if len(hashes) == 0 {
+				return io.EOF // done
+			}
+			return nil
+		})
+		total += n
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"dbfs/btree"
+)
+
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	db := &btree.KV{Store: btree.NewMemStore()}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return New(db)
+}
+
+func randBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func mustPut(t *testing.T, s *Store, name string, data []byte) PutStats {
+	t.Helper()
+	stats, err := s.Put(name, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != int64(len(data)) {
+		t.Fatalf("put %s: %+v", name, stats)
+	}
+	return stats
+}
+
+func mustGet(t *testing.T, s *Store, name string, want []byte) {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if _, err := s.Get(name, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("get %s: %d bytes, want %d", name, buf.Len(), len(want))
+	}
+}
+
+// the number of keys in each bucket
+func countKeys(t *testing.T, s *Store) (blobs, chunks, data, garbage int) {
+	t.Helper()
+	err := s.view(func(t *txn) error {
+		for _, b := range []struct {
+			bucket *btree.Bucket
+			n      *int
+		}{{t.blobs, &blobs}, {t.chunks, &chunks}, {t.data, &data}, {t.garbage, &garbage}} {
+			err := b.bucket.Scan(nil, func(key []byte, _ []byte) bool {
+				if len(key) > 0 {
+					*b.n++
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func refs(t *testing.T, s *Store, hash Hash) uint64 {
+	t.Helper()
+	n := uint64(0)
+	err := s.view(func(t *txn) error {
+		val, ok, err := t.chunks.Get(hash[:])
+		if ok {
+			n = binary.LittleEndian.Uint64(val)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDedup(t *testing.T) {
+	s := newStore(t)
+	data := randBytes(1, 300<<10)
+	a := mustPut(t, s, "a", data)
+	if a.Chunks < 10 || a.NewChunks != a.Chunks || a.NewBytes != a.Size {
+		t.Fatalf("put a: %+v", a)
+	}
+	// the same content
+	if b := mustPut(t, s, "b", data); b.NewChunks != 0 || b.Chunks != a.Chunks {
+		t.Fatalf("put b: %+v", b)
+	}
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:100<<10]...), "inserted"...), data[100<<10:]...)
+	c := mustPut(t, s, "c", edited)
+	if c.NewChunks == 0 || c.NewChunks > 2 || c.NewBytes >= c.Size/4 {
+		t.Fatalf("put c: %+v", c)
+	}
+	mustGet(t, s, "a", data)
+	mustGet(t, s, "b", data)
+	mustGet(t, s, "c", edited)
+	names := []string{}
+	if err := s.List(func(name string) bool { names = append(names, name); return true }); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Fatalf("list %v", names)
+	}
+	// the errors
+	if _, err := s.Get("x", &bytes.Buffer{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get a missing blob: %v", err)
+	}
+	if err := s.Delete("x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete a missing blob: %v", err)
+	}
+	if _, err := s.Put("", bytes.NewReader(nil)); !errors.Is(err, ErrName) {
+		t.Fatalf("empty name: %v", err)
+	}
+}
+
+func TestRefsAndGC(t *testing.T) {
+	s := newStore(t)
+	// more chunks than a GC batch
+	data := randBytes(2, (GC_BATCH+100)*(1<<CHUNK_BITS))
+	mustPut(t, s, "a", data)
+	mustPut(t, s, "b", data)
+	chunks, err := s.Chunks("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) <= GC_BATCH {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if n := refs(t, s, chunk.Hash); n != 2 {
+			t.Fatalf("refcount %d", n)
+		}
+	}
+	// a chunk is garbage only when the last reference is dropped
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, garbage := countKeys(t, s); garbage != 0 {
+		t.Fatalf("%d garbage chunks", garbage)
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, _, _, garbage := countKeys(t, s); blobs != 0 || garbage != len(chunks) {
+		t.Fatalf("%d blob keys, %d garbage chunks", blobs, garbage)
+	}
+	// a chunk referenced again before the GC is kept
+	small := data[:chunks[0].Size]
+	if stats := mustPut(t, s, "c", small); stats.NewChunks != 0 || refs(t, s, chunks[0].Hash) != 1 {
+		t.Fatalf("put c: %+v", stats)
+	}
+	n, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(chunks)-1 {
+		t.Fatalf("GC deleted %d of %d", n, len(chunks)-1)
+	}
+	_, nchunks, ndata, garbage := countKeys(t, s)
+	parts := (chunks[0].Size + PART_SIZE - 1) / PART_SIZE
+	if nchunks != 1 || ndata != parts || garbage != 0 {
+		t.Fatalf("after GC: %d chunks, %d parts, %d garbage", nchunks, ndata, garbage)
+	}
+	mustGet(t, s, "c", small)
+	// a replaced blob drops the rest of its manifest
+	mustPut(t, s, "c", nil)
+	if chunks, err := s.Chunks("c"); err != nil || len(chunks) != 0 {
+		t.Fatalf("chunks of an empty blob: %v %v", chunks, err)
+	}
+	mustGet(t, s, "c", nil)
+	if n, err := s.GC(); err != nil || n != 1 {
+		t.Fatalf("GC: %d %v", n, err)
+	}
+	if blobs, nchunks, ndata, garbage := countKeys(t, s); blobs != 1 || nchunks+ndata+garbage != 0 {
+		t.Fatalf("left: %d %d %d %d", blobs, nchunks, ndata, garbage)
+	}
+}
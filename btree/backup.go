@@ -0,0 +1,304 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// The backup format:
+// | magic | npages | gen | since | records... | end |
+// |  8B   |   8B   | 8B  |  8B   |            |     |
+//
+// A record is a page pointer followed by the page. Only the pages reachable
+// from the snapshot are included and the meta page (pointer 0) comes last.
+// An incremental backup only includes the pages written after the `since`
+// generation; a full backup has `since` = 0.
+// | ptr | page |
+// | 8B  |  4K  |
+//
+// The end marker is an all-ones pointer followed by the CRC32-C
+// of all the preceding bytes.
+const BACKUP_MAGIC = "dbfsbak1"
+const backupEnd = ^uint64(0)
+
+var (
+	ErrBadBackup = errors.New("bad backup")
+	ErrBackupGen = errors.New("backup from a future generation")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// stream a consistent copy of the DB while writes continue
+func (db *KV) Backup(w io.Writer) error {
+	return db.BackupSince(w, 0)
+}
+
+// stream the pages written after generation `since`, see `Snapshot.Gen`
+func (db *KV) BackupSince(w io.Writer, since uint64) error {
+	snap := db.Snapshot()
+	err := snap.BackupSince(w, since)
+	if rerr := snap.Release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (snap *Snapshot) Backup(w io.Writer) error {
+	return snap.BackupSince(w, 0)
+}
+
+func (snap *Snapshot) BackupSince(w io.Writer, since uint64) error {
+	assert(!snap.done, "snapshot released")
+	if since > snap.gen {
+		return fmt.Errorf("%w: %d, the last is %d", ErrBackupGen, since, snap.gen)
+	}
+	bw := newBackupWriter(w, snap.npages, snap.gen, since)
+	emit := func(ptr uint64, node BNode) error {
+		return bw.page(ptr, node)
+	}
+	for _, tree := range []*BTree{&snap.tree, &snap.log} {
+		if tree.root == 0 {
+			continue
+		}
+		if err := walkTree(tree, tree.root, since, emit); err != nil {
+			return err
+		}
+	}
+	// the catalog and the buckets
+	if err := walkBucket(&snap.cat, bucketRef(&snap.cat), since, emit); err != nil {
+		return err
+	}
+	for ptr, node := range snap.free {
+		if node.gen() <= since {
+			continue
+		}
+		if err := emit(ptr, node); err != nil {
+			return err
+		}
+	}
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, snap.meta)
+	if err := emit(0, meta); err != nil {
+		return err
+	}
+	return bw.finish()
+}
+
+// visit the pages of a tree written after generation `since` in pre-order.
+// a page is copied whenever a kid is updated, so an old page has no newer kids.
+// 0 visits every page, including the uncommitted ones, which have no generation.
+func walkTree(tree *BTree, ptr uint64, since uint64, fn func(uint64, BNode) error) error {
+	node := BNode(tree.get(ptr))
+	if since > 0 && node.gen() <= since {
+		return nil
+	}
+	if err := fn(ptr, node); err != nil {
+		return err
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := walkTree(tree, node.getPtr(i), since, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type backupWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func newBackupWriter(w io.Writer, npages uint64, gen uint64, since uint64) *backupWriter {
+	bw := &backupWriter{w: bufio.NewWriter(w), crc: crc32.New(crcTable)}
+	var head [32]byte
+	copy(head[:8], BACKUP_MAGIC)
+	binary.LittleEndian.PutUint64(head[8:], npages)
+	binary.LittleEndian.PutUint64(head[16:], gen)
+	binary.LittleEndian.PutUint64(head[24:], since)
+	bw.write(head[:])
+	return bw
+}
+
+func (bw *backupWriter) write(data []byte) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(data)
+		bw.crc.Write(data)
+	}
+}
+
+func (bw *backupWriter) page(ptr uint64, node BNode) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], ptr)
+	bw.write(buf[:])
+	bw.write(node[:BTREE_PAGE_SIZE])
+	return bw.err
+}
+
+func (bw *backupWriter) finish() error {
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[:8], backupEnd)
+	bw.crc.Write(buf[:8])
+	binary.LittleEndian.PutUint32(buf[8:], bw.crc.Sum32())
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(buf[:])
+	}
+	if bw.err == nil {
+		bw.err = bw.w.Flush()
+	}
+	return bw.err
+}
+
+// materialize a full backup followed by a chain of incremental backups
+// into a new DB file. each incremental backup must start at or before the
+// generation reached by the previous one.
+func Restore(base io.Reader, file string, incrementals ...io.Reader) error {
+	fp, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	if err = restoreFile(fp, append([]io.Reader{base}, incrementals...)); err == nil {
+		err = syncDir(path.Dir(file))
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+type backupHeader struct {
+	npages uint64
+	gen    uint64
+	since  uint64
+}
+
+func restoreFile(fp *os.File, chain []io.Reader) error {
+	var last backupHeader
+	var meta []byte
+	for i, r := range chain {
+		head, m, err := applyBackup(fp, r)
+		if err != nil {
+			return err
+		}
+		if i == 0 && head.since != 0 {
+			return fmt.Errorf("%w: the first backup is incremental", ErrBadBackup)
+		}
+		if i > 0 && (head.since > last.gen || head.gen < last.gen) {
+			return fmt.Errorf("%w: generation %d..%d does not follow %d",
+				ErrBadBackup, head.since, head.gen, last.gen)
+		}
+		last, meta = head, m
+	}
+	// the data pages are durable before the meta page makes them visible
+	if err := fp.Truncate(int64(last.npages * BTREE_PAGE_SIZE)); err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+	if _, err := fp.WriteAt(meta, 0); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
+
+// write the pages of a backup to the file, return the meta page
+func applyBackup(w io.WriterAt, r io.Reader) (backupHeader, []byte, error) {
+	br := newBackupReader(r)
+	head, err := br.header()
+	if err != nil {
+		return head, nil, err
+	}
+	meta, err := br.apply(w, head)
+	return head, meta, err
+}
+
+type backupReader struct {
+	in  io.Reader
+	crc hash.Hash32
+}
+
+// reuses `r` if it is already buffered, so that a stream of backups
+// can be read one by one.
+func newBackupReader(r io.Reader) *backupReader {
+	crc := crc32.New(crcTable)
+	return &backupReader{in: io.TeeReader(bufio.NewReader(r), crc), crc: crc}
+}
+
+func (br *backupReader) header() (backupHeader, error) {
+	var buf [32]byte
+	if _, err := io.ReadFull(br.in, buf[:]); err != nil {
+		return backupHeader{}, err
+	}
+	if string(buf[:8]) != BACKUP_MAGIC {
+		return backupHeader{}, ErrBadBackup
+	}
+	return backupHeader{
+		npages: binary.LittleEndian.Uint64(buf[8:]),
+		gen:    binary.LittleEndian.Uint64(buf[16:]),
+		since:  binary.LittleEndian.Uint64(buf[24:]),
+	}, nil
+}
+
+// write the pages that follow the header, return the meta page
+func (br *backupReader) apply(w io.WriterAt, head backupHeader) ([]byte, error) {
+	var buf [8]byte
+	var meta []byte
+	page := make([]byte, BTREE_PAGE_SIZE)
+	for {
+		if _, err := io.ReadFull(br.in, buf[:]); err != nil {
+			return nil, err
+		}
+		ptr := binary.LittleEndian.Uint64(buf[:])
+		if ptr == backupEnd {
+			break
+		}
+		if ptr >= head.npages {
+			return nil, ErrBadBackup
+		}
+		if _, err := io.ReadFull(br.in, page); err != nil {
+			return nil, err
+		}
+		if ptr == 0 {
+			meta = clone(page)
+			continue
+		}
+		if _, err := w.WriteAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return nil, err
+		}
+	}
+	sum := br.crc.Sum32()
+	if _, err := io.ReadFull(br.in, buf[:4]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != sum || meta == nil {
+		return nil, ErrBadBackup
+	}
+	if !bytes.Equal(meta[:16], []byte(DB_SIG)) {
+		return nil, ErrBadBackup
+	}
+	return meta, nil
+}
+
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
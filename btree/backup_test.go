@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"testing"
+)
+
+// a snapshot of the DB and its backup since `since`
+func backupAt(t *testing.T, db *KV, since uint64) (*bytes.Buffer, uint64) {
+	t.Helper()
+	snap := db.Snapshot()
+	defer snap.Release()
+	b := &bytes.Buffer{}
+	if err := snap.BackupSince(b, since); err != nil {
+		t.Fatal(err)
+	}
+	return b, snap.Gen()
+}
+
+func restored(t *testing.T, base io.Reader, incrementals ...io.Reader) map[string]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(base, path, incrementals...); err != nil {
+		t.Fatal(err)
+	}
+	db := openKV(t, &KV{Path: path})
+	checkPages(t, db)
+	return dumpKV(db)
+}
+
+func TestBackupChain(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	setKeys(t, db, 3000, "v0")
+	full, gen0 := backupAt(t, db, 0)
+	v0 := dumpKV(db)
+
+	setKeys(t, db, 100, "v1")
+	if _, err := db.Del([]byte("key0250")); err != nil {
+		t.Fatal(err)
+	}
+	inc1, gen1 := backupAt(t, db, gen0)
+	v1 := dumpKV(db)
+	if inc1.Len() >= full.Len() {
+		t.Fatalf("incremental backup of %d bytes, full %d bytes", inc1.Len(), full.Len())
+	}
+
+	setKeys(t, db, 10, "v2")
+	inc2, _ := backupAt(t, db, gen1)
+	v2 := dumpKV(db)
+
+	for _, c := range []struct {
+		name  string
+		chain []*bytes.Buffer
+		want  map[string]string
+	}{
+		{"full", []*bytes.Buffer{full}, v0},
+		{"full+1", []*bytes.Buffer{full, inc1}, v1},
+		{"full+1+2", []*bytes.Buffer{full, inc1, inc2}, v2},
+	} {
+		readers := []io.Reader{}
+		for _, b := range c.chain {
+			readers = append(readers, bytes.NewReader(b.Bytes()))
+		}
+		if got := restored(t, readers[0], readers[1:]...); !maps.Equal(got, c.want) {
+			t.Fatalf("%s: restored %d keys, want %d", c.name, len(got), len(c.want))
+		}
+	}
+
+	// chains out of order
+	for name, chain := range map[string][]*bytes.Buffer{
+		"incremental base": {inc1},
+		"missing link":     {full, inc2},
+		"reversed":         {full, inc2, inc1},
+	} {
+		readers := []io.Reader{}
+		for _, b := range chain {
+			readers = append(readers, bytes.NewReader(b.Bytes()))
+		}
+		path := filepath.Join(t.TempDir(), "db")
+		if err := Restore(readers[0], path, readers[1:]...); !errors.Is(err, ErrBadBackup) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	// a corrupted backup
+	bad := bytes.Clone(full.Bytes())
+	bad[len(bad)/2] ^= 1
+	if err := Restore(bytes.NewReader(bad), filepath.Join(t.TempDir(), "db")); !errors.Is(err, ErrBadBackup) {
+		t.Fatalf("corrupted: %v", err)
+	}
+}
+
+func TestBackupFutureGen(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	setKeys(t, db, 10, "v")
+	snap := db.Snapshot()
+	defer snap.Release()
+	err := snap.BackupSince(io.Discard, snap.Gen()+1)
+	if !errors.Is(err, ErrBackupGen) {
+		t.Fatalf("backup since %d: %v", snap.Gen()+1, err)
+	}
+	if err := snap.BackupSince(io.Discard, snap.Gen()); err != nil {
+		t.Fatal(fmt.Errorf("backup of nothing: %w", err))
+	}
+}
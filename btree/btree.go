@@ -1,7 +1,6 @@
 package btree
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
@@ -27,9 +26,27 @@ type BTree struct {
 	new func([]byte) uint64 // allocate a new page with data
 	del func(uint64)        // deallocate a page number
 
+	cmp *Comparator // key order, nil for bytewise
+
+	metrics *metrics // counters of the KV, nil for none
+
+	// compress the inserted values of at least `compressMin` bytes
+	codec       Codec
+	compressMin int
+
+	policy NodePolicy // node splits and merges
 }
 
+// node header:
+// | type | nkeys | gen |
+// |  2B  |  2B   | 8B  |
+// `gen` is the generation of the commit that wrote the page.
+const BNODE_HEADER = 12
+
 const BTREE_PAGE_SIZE = 4096
+// the end of a page is reserved for the nonce and tag of an encrypted page
+const PAGE_TRAILER = 28
+const BTREE_NODE_MAX = BTREE_PAGE_SIZE - PAGE_TRAILER
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
@@ -39,8 +56,8 @@ func assert(p bool, msg string) {
 	}
 }
 func init() {
-	node1max := 4 + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1max<=BTREE_PAGE_SIZE, "size too big")
+	node1max := BNODE_HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
+	assert(node1max<=BTREE_NODE_MAX, "size too big")
 }
 
 // getters
@@ -57,23 +74,31 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node[2:4], nkeys)
 }
 
+// the commit generation that wrote the page
+func (node BNode) gen() uint64 {
+	return binary.LittleEndian.Uint64(node[4:12])
+}
+func (node BNode) setGen(gen uint64) {
+	binary.LittleEndian.PutUint64(node[4:12], gen)
+}
+
 // r/w child pointers array
 func (node BNode) getPtr(idx uint16) uint64 {
 	assert(idx < node.nkeys(), "getptr")
-	pos := 4 + 8*idx
+	pos := BNODE_HEADER + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 func (node BNode) setPtr(idx uint16, val uint64) {
 	assert(idx < node.nkeys(), "setptr")
-	pos := 4 + 8*idx
-	binary.BigEndian.PutUint64(node[pos:], val)
+	pos := BNODE_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[pos:], val)
 }
 
 func offsetPos(node BNode, idx uint16) uint16 {
-	assert(idx >= 1 || idx <= node.nkeys(), "offsetPos: Index out of bounds!")
+	assert(idx >= 1 && idx <= node.nkeys(), "offsetPos: Index out of bounds!")
 
-	return 4 + 8*node.nkeys() + 2*(idx-1)
+	return BNODE_HEADER + 8*node.nkeys() + 2*(idx-1)
 }
 
 // read offset array
@@ -81,7 +106,7 @@ func (node BNode) getOffset(idx uint16) uint16 {
 	if idx == 0 {
 		return 0
 	}
-	pos := 4 + 8*node.nkeys() + 2*(idx-1)
+	pos := BNODE_HEADER + 8*node.nkeys() + 2*(idx-1)
 	return binary.LittleEndian.Uint16(node[pos:])
 }
 
@@ -91,7 +116,7 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 }
 func (node BNode) kvPos(idx uint16) uint16 {
 	assert(idx <= node.nkeys(), "kvpos")
-	return 4 + 8*node.nkeys() + 2*node.nkeys() + node.getOffset((idx))
+	return BNODE_HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset((idx))
 }
 func (node BNode) getKey(idx uint16) []byte {
 	assert(idx < node.nkeys(), "getkeys")
@@ -100,25 +125,38 @@ func (node BNode) getKey(idx uint16) []byte {
 	return node[pos+4:][:klen]
 }
 
+// the value, decompressed if it is compressed
 func (node BNode) getVal(idx uint16) []byte {
+	val, codec := node.getStoredVal(idx)
+	return decodeVal(codec, val)
+}
+
+// the value as it is in the node
+func (node BNode) getStoredVal(idx uint16) ([]byte, Codec) {
 	assert(idx < node.nkeys(), "gatval")
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
 	vlen := binary.LittleEndian.Uint16(node[pos+2:])
-	return node[pos+4+klen:][:vlen] //pos is location of kv pair, 4 is {2 for key len and 2 for val len}, klen is length of key and is later sliced till vlen to get only val
+	codec := Codec(vlen >> VAL_LEN_BITS) // the top bits of the length
+	return node[pos+4+klen:][:vlen&VAL_LEN_MASK], codec //pos is location of kv pair, 4 is {2 for key len and 2 for val len}, klen is length of key and is later sliced till vlen to get only val
 }
 
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	nodeAppendStored(new, idx, ptr, key, val, CODEC_NONE)
+}
+
+// append a value encoded by `codec`
+func nodeAppendStored(new BNode, idx uint16, ptr uint64, key []byte, val []byte, codec Codec) {
 	new.setPtr(idx, ptr)
 	pos := new.kvPos(idx)
 
 	binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
+	binary.LittleEndian.PutUint16(new[pos+2:], uint16(codec)<<VAL_LEN_BITS|uint16(len(val)))
 
 	copy(new[pos+4:], key)
 	copy(new[pos+4+uint16(len(key)):], val)
 
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(key)+len(val))))
+	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
 }
 
 func (node BNode) nbytes() uint16 {
@@ -128,29 +166,31 @@ func (node BNode) nbytes() uint16 {
 func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
 	for i := uint16(0); i < n; i++ {
 		dst, src := dstNew+i, srcOld+i
-		nodeAppendKV(new, dst, old.getPtr(src), old.getKey(src), old.getVal(src))
+		val, codec := old.getStoredVal(src) // copied as is
+		nodeAppendStored(new, dst, old.getPtr(src), old.getKey(src), val, codec)
 	}
 }
-func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+// `val` is encoded by `codec`
+func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte, codec Codec) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)                   // copy keys before idx
-	nodeAppendKV(new, idx, 0, key, val)                    //new keys
+	nodeAppendStored(new, idx, 0, key, val, codec)         //new keys
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx) //keys from idx
 }
 
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte, codec Codec) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendStored(new, idx, 0, key, val, codec)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
 // find the last postion that is less than or equal to the key
-func nodeLookupLE(node BNode, key []byte) uint16 { // cna be binary search, rn linear
+func nodeLookupLE(tree *BTree, node BNode, key []byte) uint16 { // cna be binary search, rn linear
 	nkeys := node.nkeys()
 	var i uint16
 	for i = 0; i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+		cmp := tree.compare(node.getKey(i), key)
 		if cmp == 0 {
 			return i
 		}
@@ -163,20 +203,25 @@ func nodeLookupLE(node BNode, key []byte) uint16 { // cna be binary search, rn l
 
 //For an in-memory B+tree, an oversized node can be split into 2 nodes, each with half of the keys. For a disk-based B+tree, half of the keys may not fit into a page due to uneven key sizes. However, we can use the half position as an initial guess, then move it left or right if the half is too large.
 
-func nodeSplit2(left BNode, right BNode, old BNode) {
+// A right-biased split fills the left node up to `leftMax` bytes instead.
+func nodeSplit2(left BNode, right BNode, old BNode, leftMax uint16) {
 	assert(old.nkeys() >= 2, "nodesplit")
 	nleft := old.nkeys() / 2
 	leftbytes := func() uint16 {
-		return 4 + 8*nleft + 2*nleft + old.getOffset(nleft)
+		return BNODE_HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
 	}
-	for leftbytes() > BTREE_PAGE_SIZE {
+	limit := uint16(BTREE_NODE_MAX)
+	if leftMax > 0 {
+		nleft, limit = old.nkeys()-1, leftMax // as many keys as fit
+	}
+	for nleft > 1 && leftbytes() > limit {
 		nleft--
 	}
 	assert(nleft >= 1, "nleft_split if less")
 	rightbytes := func() uint16 {
-		return old.nbytes() - leftbytes() + 4
+		return old.nbytes() - leftbytes() + BNODE_HEADER
 	}
-	for rightbytes() > BTREE_PAGE_SIZE {
+	for rightbytes() > BTREE_NODE_MAX {
 		nleft++
 	}
 	assert(nleft < old.nkeys(), "nleft too big")
@@ -189,25 +234,26 @@ func nodeSplit2(left BNode, right BNode, old BNode) {
 	nodeAppendRange(right, old, 0, nleft, nright)
 
 	//if left too big
-	assert(right.nbytes() <= BTREE_PAGE_SIZE, "left still too big")
+	assert(right.nbytes() <= BTREE_NODE_MAX, "left still too big")
 }
 
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
+// `leftMax` is 0 to split at the middle
+func nodeSplit3(old BNode, leftMax uint16) (uint16, [3]BNode) {
+	if old.nbytes() <= BTREE_NODE_MAX {
 		old = old[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{old} //not split
 	}
 	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
 	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
+	nodeSplit2(left, right, old, leftMax)
+	if left.nbytes() <= BTREE_NODE_MAX {
 		left = left[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
 	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
 	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, "node split 3")
+	nodeSplit2(leftleft, middle, left, leftMax)
+	assert(leftleft.nbytes() <= BTREE_NODE_MAX, "node split 3")
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
@@ -224,31 +270,54 @@ func nodeReplaceKidN(
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
+// replace 2 links with 2 new kids, whose separators may have changed
+func nodeReplace2Kids(tree *BTree, new BNode, old BNode, idx uint16, left BNode, right BNode) {
+	new.setHeader(BNODE_NODE, old.nkeys())
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, tree.new(left), left.getKey(0), nil)
+	nodeAppendKV(new, idx+1, tree.new(right), right.getKey(0), nil)
+	nodeAppendRange(new, old, idx+2, idx+2, old.nkeys()-(idx+2))
+}
 func nodeReplace2Kid(new BNode, old BNode, idx uint16, merged uint64, key []byte) {
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, merged, key, nil)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// insert by the mode of the request, returns an empty node if unchanged
+func treeInsert(tree *BTree, req *UpdateReq, node BNode) BNode {
+	key := req.Key
 	// The extra size allows it to exceed 1 page temporarily.
 	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 	// where to insert the key?
-	idx := nodeLookupLE(node, key) // node.getKey(idx) <= key
+	idx := nodeLookupLE(tree, node, key) // node.getKey(idx) <= key
 	switch node.btype() {
 	case BNODE_LEAF: // leaf node
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(new, node, idx, key, val) // found, update it
+		found := tree.compare(key, node.getKey(idx)) == 0
+		if found {
+			req.Old = node.getVal(idx)
+		}
+		if !req.apply(found) {
+			return BNode{}
+		}
+		stored, codec := tree.encodeVal(req.Val)
+		if found {
+			leafUpdate(new, node, idx, key, stored, codec) // found, update it
+			req.Status = STATUS_UPDATED
 		} else {
-			leafInsert(new, node, idx+1, key, val) // not found, insert
+			leafInsert(new, node, idx+1, key, stored, codec) // not found, insert
+			req.Status = STATUS_ADDED
 		}
 	case BNODE_NODE:
 		// recursive insertion to the kid node
 		kptr := node.getPtr(idx)
-		knode := treeInsert(tree, tree.get(kptr), key, val)
+		knode := treeInsert(tree, req, tree.get(kptr))
+		if len(knode) == 0 {
+			return BNode{} // unchanged
+		}
 		// after insertion, split the result
-		nsplit, split := nodeSplit3(knode)
+		nsplit, split := tree.split(knode, key)
 		// deallocate the old kid node
 		tree.del(kptr)
 		// update the kid links
@@ -1,25 +1,77 @@
 package btree
 
-import "bytes"
+// a tree on the pages of the callbacks, in the order of `cmp` (nil for
+// bytewise). the order can't change once keys are inserted.
+func NewBTree(cmp *Comparator, get func(uint64) []byte, new func([]byte) uint64, del func(uint64)) BTree {
+	if cmp != nil {
+		assert(len(cmp.Name) > 0 && len(cmp.Name) <= MAX_COMPARATOR_NAME, "bad comparator name")
+	}
+	return BTree{get: get, new: new, del: del, cmp: cmp}
+}
 
+// look up a key, the returned value is only valid until the next update
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	if tree.root == 0 || len(key) == 0 {
+		return nil, false
+	}
+	node := BNode(tree.get(tree.root))
+	for {
+		idx := nodeLookupLE(tree, node, key)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if tree.compare(key, node.getKey(idx)) != 0 {
+				return nil, false
+			}
+			return node.getVal(idx), true
+		case BNODE_NODE:
+			node = tree.get(node.getPtr(idx))
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+// insert or replace a key
 func (tree *BTree) Insert(key []byte, val []byte) error {
+	return tree.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// insert by the mode of the request, and report the result in it
+func (tree *BTree) Update(req *UpdateReq) error {
+	key, val := req.Key, req.Val
 	assert(len(key) != 0, "empty key") //check lengths by node format
 	assert(len(key) <= BTREE_MAX_KEY_SIZE, "key too big")
 	assert(len(val) <= BTREE_MAX_VAL_SIZE, "val too big")
+	req.Status, req.Old = STATUS_UNCHANGED, nil
 
 	if tree.root == 0 { // create first node
+		if !req.apply(false) {
+			return nil
+		}
 		root := BNode(make([]byte, BTREE_PAGE_SIZE))
 		root.setHeader(BNODE_LEAF, 2)
 		// dummy key(smallest key) for lookupLE func to find and take key space
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		stored, codec := tree.encodeVal(val)
+		nodeAppendStored(root, 1, 0, key, stored, codec)
+		tree.root = tree.new(root)
+		req.Status = STATUS_ADDED
 		return nil
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val) //insert key
-
-	nsplit, split := nodeSplit3(node) //grow tree if root split
+	node := treeInsert(tree, req, tree.get(tree.root)) //insert key
+	if len(node) == 0 {
+		return nil // unchanged
+	}
 	tree.del(tree.root)
+	setRoot(tree, node, key)
+	return nil
+}
+
+// replace the root with an updated node, which may be split.
+// `key` is the inserted key, nil for deletions.
+func setRoot(tree *BTree, node BNode, key []byte) {
+	nsplit, split := tree.split(node, key) //grow tree if root split
 	if nsplit > 1 {
 		root := BNode(make([]byte, BTREE_PAGE_SIZE))
 		root.setHeader(BNODE_NODE, nsplit)
@@ -31,38 +83,59 @@ func (tree *BTree) Insert(key []byte, val []byte) error {
 	} else {
 		tree.root = tree.new(split[0])
 	}
-	return nil
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) { //shoulf updated child be merged with sibling?
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if int(updated.nbytes()) > tree.policy.mergeMax() {
 		return 0, BNode{}
 	}
 	if idx > 0 {
 		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - 4
-		if merged <= BTREE_PAGE_SIZE {
+		merged := sibling.nbytes() + updated.nbytes() - BNODE_HEADER
+		if merged <= BTREE_NODE_MAX {
 			return -1, sibling //left
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - 4
-		if merged <= BTREE_PAGE_SIZE {
+		merged := sibling.nbytes() + updated.nbytes() - BNODE_HEADER
+		if merged <= BTREE_NODE_MAX {
 			return 1, sibling //right
 		}
 	}
 	return 0, BNode{}
 }
 
+// an underfull kid that can't be merged takes keys from a sibling instead.
+// returns the 2 kids after the redistribution, which is skipped if it
+// doesn't move any key, like when a large KV dominates the sibling.
+func shouldBorrow(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode, BNode) {
+	if updated.nkeys() == 0 || int(updated.nbytes()) > tree.policy.mergeMax() {
+		return 0, BNode{}, BNode{}
+	}
+	if idx > 0 {
+		sibling := BNode(tree.get(node.getPtr(idx - 1)))
+		if left, right := nodeRedistribute(sibling, updated); left.nkeys() != sibling.nkeys() {
+			return -1, left, right //left
+		}
+	}
+	if idx+1 < node.nkeys() {
+		sibling := BNode(tree.get(node.getPtr(idx + 1)))
+		if left, right := nodeRedistribute(updated, sibling); left.nkeys() != updated.nkeys() {
+			return 1, left, right //right
+		}
+	}
+	return 0, BNode{}, BNode{}
+}
+
 // delete a key from the tree
 func treeDelete(tree *BTree, node BNode, key []byte) BNode{
 	// where to find the key?
-idx := nodeLookupLE(node, key)
+idx := nodeLookupLE(tree, node, key)
 // act depending on the node type
 switch node.btype() {
 case BNODE_LEAF:
-if !bytes.Equal(key, node.getKey(idx)) {
+if tree.compare(key, node.getKey(idx)) != 0 {
 return BNode{} // not found
 }
 // delete the key in the leaf
@@ -85,16 +158,23 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		return BNode{} // not found
 	}
 	tree.del(kptr)
-	// check for merging
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	// check for merging. a new separator key can be longer than the old
+	// one, so the node can exceed 1 page and be split like an insertion.
+	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	borrowDir, left, right := 0, BNode{}, BNode{}
+	if mergeDir == 0 {
+		borrowDir, left, right = shouldBorrow(tree, node, idx, updated)
+	}
 	switch {
 	case mergeDir < 0: // left
+		tree.countMerge()
 		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
 		nodeMerge(merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
 		nodeReplace2Kid(new, node, idx-1, uint64(tree.new(merged)), merged.getKey(0))
 	case mergeDir > 0: // right
+		tree.countMerge()
 		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
 		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
@@ -102,8 +182,17 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0, "1 empty child but no sibling") // 1 empty child but no sibling
 		new.setHeader(BNODE_NODE, 0)                                          // the parent becomes empty too
+	case borrowDir < 0: // from the left
+		tree.countBorrow()
+		tree.del(node.getPtr(idx - 1))
+		nodeReplace2Kids(tree, new, node, idx-1, left, right)
+	case borrowDir > 0: // from the right
+		tree.countBorrow()
+		tree.del(node.getPtr(idx + 1))
+		nodeReplace2Kids(tree, new, node, idx, left, right)
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		nsplit, split := tree.split(updated, nil)
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
 	}
 	return new
 }
@@ -121,6 +210,18 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
+
+// split the keys of 2 adjacent kids evenly by size, the kids don't fit in
+// 1 node, so both end up about half full.
+func nodeRedistribute(left BNode, right BNode) (BNode, BNode) {
+	both := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	nodeMerge(both, left, right)
+	newLeft := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newRight := BNode(make([]byte, BTREE_PAGE_SIZE))
+	nodeSplit2(newLeft, newRight, both, min((both.nbytes()+BNODE_HEADER)/2, BTREE_NODE_MAX))
+	assert(newLeft.nbytes() <= BTREE_NODE_MAX && newRight.nbytes() <= BTREE_NODE_MAX, "redistributed node too big")
+	return newLeft, newRight
+}
 func (tree *BTree) Delete(key []byte) bool {
 	assert(len(key) != 0, "zero key size")
 	assert(len(key) <= BTREE_MAX_KEY_SIZE, "key size too big")
@@ -136,7 +237,7 @@ func (tree *BTree) Delete(key []byte) bool {
 		// remove a level
 		tree.root = updated.getPtr(0)
 	} else {
-		tree.root = tree.new(updated)
+		setRoot(tree, updated, nil)
 	}
 	return true
 }
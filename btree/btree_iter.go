@@ -0,0 +1,112 @@
+package btree
+
+// B-tree iterator, a path from the root to a position in a leaf
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter
+	}
+	for ptr := tree.root; ptr != 0; {
+		node := BNode(tree.get(ptr))
+		idx := nodeLookupLE(tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// find the first position that is greater or equal to the input key
+func (tree *BTree) SeekGE(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.Valid() {
+		if cur, _ := iter.Deref(); tree.compare(cur, key) == 0 {
+			return iter
+		}
+	}
+	if len(iter.path) > 0 {
+		iter.Next()
+	}
+	return iter
+}
+
+// the iterator is out of range when it points to nothing or to the dummy key
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	if iter.pos[last] >= node.nkeys() {
+		return false
+	}
+	return len(node.getKey(iter.pos[last])) > 0
+}
+
+// get the current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	assert(iter.Valid(), "deref invalid iterator")
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	return node.getKey(iter.pos[last]), node.getVal(iter.pos[last])
+}
+
+// move to the next key
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 {
+		return
+	}
+	if !iterNext(iter, len(iter.path)-1) {
+		last := len(iter.path) - 1
+		iter.pos[last] = iter.path[last].nkeys() // past the last key
+	}
+}
+
+// move to the previous key, stops at the dummy key
+func (iter *BIter) Prev() {
+	if len(iter.path) == 0 {
+		return
+	}
+	iterPrev(iter, len(iter.path)-1)
+}
+
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // no more keys
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false // no more keys
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := BNode(iter.tree.get(iter.path[level].getPtr(iter.pos[level])))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// a key of one of the sizes, including the max size that forces 3-way splits
+func testKey(id int) string {
+	size := []int{8, 16, 100, 300, BTREE_MAX_KEY_SIZE}[id%5]
+	key := fmt.Sprintf("%08d", id)
+	return key + strings.Repeat("k", size-len(key))
+}
+
+func testVal(id int, size int) string {
+	val := fmt.Sprintf("%d:", id)
+	return (val + strings.Repeat("v", max(size-len(val), 0)))[:min(max(size, len(val)), BTREE_MAX_VAL_SIZE)]
+}
+
+// compare the tree with the reference data and check the pages
+func (c *C) verify(t testing.TB) {
+	t.Helper()
+	if err := c.tree.Check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	// contents and order
+	keys := []string{}
+	for iter := c.tree.SeekGE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if ref, ok := c.ref[string(key)]; !ok || ref != string(val) {
+			t.Fatalf("key %.20q: got %d bytes, ref %d bytes (%v)", key, len(val), len(ref), ok)
+		}
+		keys = append(keys, string(key))
+	}
+	if len(keys) != len(c.ref) {
+		t.Fatalf("got %d keys, ref %d keys", len(keys), len(c.ref))
+	}
+	if !slices.IsSorted(keys) {
+		t.Fatal("keys out of order")
+	}
+	for key, val := range c.ref {
+		got, ok := c.tree.Get([]byte(key))
+		if !ok || !bytes.Equal(got, []byte(val)) {
+			t.Fatalf("get %.20q", key)
+		}
+	}
+	// the pages are exactly the reachable nodes
+	reachable := map[uint64]bool{}
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		if reachable[ptr] {
+			t.Fatalf("page %d is reachable twice", ptr)
+		}
+		reachable[ptr] = true
+		node := BNode(c.pages[ptr])
+		if node == nil {
+			t.Fatalf("page %d is not allocated", ptr)
+		}
+		if len(node) != BTREE_PAGE_SIZE || node.nbytes() > BTREE_NODE_MAX {
+			t.Fatalf("page %d: %d bytes, node %d bytes", ptr, len(node), node.nbytes())
+		}
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	if c.tree.root != 0 {
+		walk(c.tree.root)
+	}
+	if len(reachable) != len(c.pages) {
+		t.Fatalf("%d pages, %d reachable", len(c.pages), len(reachable))
+	}
+}
+
+// run random operations, verify the tree periodically
+func randomOps(t *testing.T, c *C, rng *rand.Rand, nops int, nkeys int, maxVal int) {
+	for i := 0; i < nops; i++ {
+		id := rng.Intn(nkeys)
+		if rng.Intn(3) == 0 {
+			_, exists := c.ref[testKey(id)]
+			if c.Del(testKey(id)) != exists {
+				t.Fatalf("op %d: delete %d returned %v", i, id, !exists)
+			}
+		} else {
+			c.Add(testKey(id), testVal(i, rng.Intn(maxVal+1)))
+		}
+		if i%97 == 0 {
+			c.verify(t)
+		}
+	}
+	c.verify(t)
+}
+
+func TestBTreeRandom(t *testing.T) {
+	for seed := int64(0); seed < 8; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			c := NewC()
+			randomOps(t, c, rng, 3000, 400, BTREE_MAX_VAL_SIZE)
+			// shrink to nothing, through merges
+			for key := range c.ref {
+				c.Del(key)
+			}
+			c.verify(t)
+		})
+	}
+}
+
+func TestBTreeSmallValues(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	c := NewC()
+	randomOps(t, c, rng, 20000, 5000, 16)
+}
+
+// max-size keys and values, every insert into a full leaf splits it in 3
+func TestBTreeMaxSizes(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%04d", (i*37)%200)
+		key += strings.Repeat("k", BTREE_MAX_KEY_SIZE-len(key))
+		c.Add(key, strings.Repeat("v", BTREE_MAX_VAL_SIZE))
+		c.verify(t)
+	}
+	for i := 0; i < 200; i += 2 {
+		key := fmt.Sprintf("%04d", i)
+		c.Del(key + strings.Repeat("k", BTREE_MAX_KEY_SIZE-len(key)))
+	}
+	c.verify(t)
+}
+
+// ops of 3 bytes: | op, key id | key id | value size |
+func FuzzBTree(f *testing.F) {
+	f.Add([]byte{0, 1, 255, 0, 4, 255, 0, 9, 255, 1, 4, 0})
+	f.Add(bytes.Repeat([]byte{0, 0, 200, 0, 5, 250, 1, 0, 0}, 20))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := NewC()
+		for ; len(data) >= 3; data = data[3:] {
+			id := int(data[0]&0x7f)<<8 | int(data[1])
+			if data[0]&0x80 != 0 {
+				c.Del(testKey(id))
+			} else {
+				c.Add(testKey(id), testVal(id, int(data[2])*12))
+			}
+		}
+		c.verify(t)
+	})
+}
+
+// open a DB, which is closed at the end of the test unless closed before
+func openKV(tb testing.TB, db *KV) *KV {
+	tb.Helper()
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if db.store != nil {
+			_ = db.Close()
+		}
+	})
+	return db
+}
@@ -0,0 +1,527 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Buckets are named trees in the same file. The catalog tree maps the name
+// of a top-level bucket to its root and comparator. Buckets can be nested:
+// a value in a bucket is either a user value or a nested bucket, and a
+// bucket that fits in a small leaf is stored inline in its parent's value.
+// Whenever a root changes, the values are updated up to the catalog, so all
+// the trees are committed atomically with the meta page.
+//
+// The value format in buckets:
+// | VAL_PLAIN  | user value |
+// | VAL_BUCKET | root (8B) | comparator |
+// | VAL_INLINE | comparator length (1B) | comparator | leaf node |
+//
+// The catalog only contains buckets.
+const (
+	VAL_PLAIN  = 0
+	VAL_BUCKET = 1
+	VAL_INLINE = 2
+)
+
+// the largest leaf that is stored inline
+const BUCKET_INLINE_MAX = BTREE_PAGE_SIZE / 4
+
+var (
+	ErrNoBucket     = errors.New("bucket not found")
+	ErrBucketExists = errors.New("bucket already exists")
+	ErrIsBucket     = errors.New("key is a bucket")
+
+	// an update of `Bucket.update` that changed nothing
+	errUnchanged = errors.New("unchanged")
+)
+
+// a handle of a bucket, either within a transaction,
+// or running each operation as a transaction.
+type Bucket struct {
+	db   *KV
+	tx   *KVTX    // nil for single-operation transactions
+	path []string // names from the top-level bucket, empty for the catalog
+}
+
+func (b *Bucket) Name() string {
+	return b.path[len(b.path)-1]
+}
+
+func (b *Bucket) Path() []string {
+	return append([]string{}, b.path...)
+}
+
+func checkBucketPath(path []string) error {
+	for _, name := range path {
+		if len(name) == 0 || len(name) > BTREE_MAX_KEY_SIZE {
+			return ErrKeySize
+		}
+	}
+	if len(encodePath(path)) > BTREE_MAX_VAL_SIZE {
+		return ErrKeySize // must fit in the change log
+	}
+	return nil
+}
+
+func lookupComparator(name []byte) (*Comparator, error) {
+	cmp := comparators[string(name)]
+	if cmp == nil {
+		return nil, fmt.Errorf("%w: %q is not registered", ErrComparator, name)
+	}
+	return cmp, nil
+}
+
+// make a tree from a bucket value, using the page callbacks of `pages`.
+// an inline bucket is copied to a new page for updates, and read in place
+// otherwise.
+func loadBucket(pages *BTree, val []byte, write bool) (BTree, error) {
+	var tree BTree
+	switch val[0] {
+	case VAL_BUCKET:
+		cmp, err := lookupComparator(val[9:])
+		if err != nil {
+			return BTree{}, err
+		}
+		tree = NewBTree(cmp, pages.get, pages.new, pages.del)
+		tree.root = binary.LittleEndian.Uint64(val[1:9])
+	case VAL_INLINE:
+		n := int(val[1])
+		cmp, err := lookupComparator(val[2 : 2+n])
+		if err != nil {
+			return BTree{}, err
+		}
+		tree = NewBTree(cmp, pages.get, pages.new, pages.del)
+		leaf := val[2+n:]
+		switch {
+		case len(leaf) == 0: // empty
+		case write:
+			page := make([]byte, BTREE_PAGE_SIZE)
+			copy(page, leaf)
+			tree.root = tree.new(page)
+		default:
+			tree.root = ^uint64(0) // not a real page
+			tree.get = func(uint64) []byte { return leaf }
+		}
+	default:
+		return BTree{}, ErrIsBucket // not a bucket
+	}
+	tree.metrics, tree.policy = pages.metrics, pages.policy
+	return tree, nil
+}
+
+// the value of a bucket that is not inline
+func bucketRef(tree *BTree) []byte {
+	val := []byte{VAL_BUCKET}
+	val = binary.LittleEndian.AppendUint64(val, tree.root)
+	return append(val, comparatorName(tree.cmp)...)
+}
+
+// encode a bucket as a value, the page of a small leaf is freed for inlining
+func storeBucket(tree *BTree) []byte {
+	if tree.root != 0 {
+		node := BNode(tree.get(tree.root))
+		if node.btype() != BNODE_LEAF || node.nbytes() > BUCKET_INLINE_MAX {
+			return bucketRef(tree)
+		}
+	}
+	name := comparatorName(tree.cmp)
+	val := []byte{VAL_INLINE, byte(len(name))}
+	val = append(val, name...)
+	if tree.root != 0 {
+		node := BNode(tree.get(tree.root))
+		val = append(val, node[:node.nbytes()]...)
+		tree.del(tree.root)
+	}
+	return val
+}
+
+// the trees from the catalog to the bucket, and the values that refer to them
+func openPath(db *KV, path []string, write bool) ([]BTree, [][]byte, error) {
+	trees := []BTree{db.catalog}
+	vals := [][]byte{nil}
+	for i, name := range path {
+		val, ok := trees[i].Get([]byte(name))
+		if !ok {
+			return trees, vals, ErrNoBucket
+		}
+		tree, err := loadBucket(&db.catalog, val, write)
+		if err == ErrIsBucket {
+			err = ErrNoBucket // a user value
+		}
+		if err != nil {
+			return trees, vals, err
+		}
+		tree.codec, tree.compressMin = db.tree.codec, db.tree.compressMin
+		trees, vals = append(trees, tree), append(vals, clone(val))
+	}
+	return trees, vals, nil
+}
+
+// store the updated trees up to the catalog. all trees opened for updates
+// must be saved to release the copies of inline buckets.
+func savePath(db *KV, path []string, trees []BTree, vals [][]byte) error {
+	for i := len(trees) - 1; i >= 1; i-- {
+		val := storeBucket(&trees[i])
+		if bytes.Equal(val, vals[i]) {
+			continue // unchanged
+		}
+		if err := trees[i-1].Insert([]byte(path[i-1]), val); err != nil {
+			return err
+		}
+	}
+	db.catalog.root = trees[0].root
+	return nil
+}
+
+// free the copies of inline buckets from `openPath` without saving the trees
+func releasePath(trees []BTree, vals [][]byte) {
+	for i := 1; i < len(trees); i++ {
+		if vals[i][0] == VAL_INLINE && trees[i].root != 0 {
+			trees[i].del(trees[i].root)
+		}
+	}
+}
+
+// visit the pages of a bucket and its nested buckets that are written
+// after generation `since`. the kids are visited before the node.
+func walkBucket(pages *BTree, val []byte, since uint64, fn func(uint64, BNode) error) error {
+	tree, err := loadBucket(pages, val, false)
+	if err != nil || tree.root == 0 {
+		return err
+	}
+	inline := val[0] == VAL_INLINE
+	visit := func(ptr uint64, node BNode) error {
+		if node.btype() == BNODE_LEAF {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				if val := node.getVal(i); len(node.getKey(i)) > 0 && val[0] != VAL_PLAIN {
+					if err := walkBucket(pages, val, since, fn); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if inline {
+			return nil // in the parent's page
+		}
+		return fn(ptr, node)
+	}
+	if inline {
+		return visit(tree.root, tree.get(tree.root))
+	}
+	return walkTree(&tree, tree.root, since, visit)
+}
+
+// give the pages of a bucket and its nested buckets to the free list,
+// including the pages of the current transaction
+func freeBucket(db *KV, val []byte) error {
+	return walkBucket(&db.catalog, val, 0, func(ptr uint64, _ BNode) error {
+		db.pageDel(ptr)
+		return nil
+	})
+}
+
+// run `fn` on the bucket tree in the handle's transaction or in a new one
+func (b *Bucket) update(fn func(tx *KVTX, tree *BTree) error) error {
+	tx := b.tx
+	if tx == nil {
+		tx = b.db.Begin()
+	} else {
+		assert(!tx.done, "transaction already finished")
+	}
+	trees, vals, err := openPath(b.db, b.path, true)
+	if err == nil {
+		err = fn(tx, &trees[len(trees)-1])
+	}
+	if err == errUnchanged {
+		if b.tx != nil {
+			releasePath(trees, vals)
+		} else {
+			b.db.Abort(tx) // nothing to commit
+		}
+		return nil
+	}
+	if serr := savePath(b.db, b.path, trees, vals); err == nil {
+		err = serr
+	}
+	if b.tx != nil {
+		return err
+	}
+	if err != nil {
+		b.db.Abort(tx)
+		return err
+	}
+	return b.db.Commit(tx)
+}
+
+// read from the handle's transaction or the last committed version
+func (b *Bucket) view(fn func(tree *BTree) error) error {
+	if b.tx == nil {
+		b.db.mu.Lock()
+		defer b.db.mu.Unlock()
+	} else {
+		assert(!b.tx.done, "transaction already finished")
+	}
+	trees, _, err := openPath(b.db, b.path, false)
+	if err != nil {
+		return err
+	}
+	return fn(&trees[len(trees)-1])
+}
+
+// the value is a copy unless the handle is in a transaction
+func (b *Bucket) Get(key []byte) ([]byte, bool, error) {
+	var val []byte
+	var ok bool
+	b.db.metrics.gets.Add(1)
+	err := b.view(func(tree *BTree) error {
+		val, ok = tree.Get(key)
+		if !ok {
+			return nil
+		}
+		if val[0] != VAL_PLAIN {
+			return ErrIsBucket
+		}
+		val = val[1:]
+		if b.tx == nil {
+			val = clone(val)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, ok, nil
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	if len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE {
+		return ErrKeySize
+	}
+	if 1+len(val) > BTREE_MAX_VAL_SIZE {
+		return ErrValSize
+	}
+	b.db.metrics.sets.Add(1)
+	return b.update(func(tx *KVTX, tree *BTree) error {
+		old, exists := tree.Get(key)
+		change := Change{Op: OpPut, Bucket: b.Path(), Key: clone(key), New: clone(val)}
+		if exists {
+			if old[0] != VAL_PLAIN {
+				return ErrIsBucket
+			}
+			change.Old = clone(old[1:])
+		}
+		req := &UpdateReq{Key: key, Val: append([]byte{VAL_PLAIN}, val...)}
+		if err := tree.Update(req); err != nil {
+			return err
+		}
+		if req.Status == STATUS_UNCHANGED {
+			return errUnchanged
+		}
+		tx.changes = append(tx.changes, change)
+		return nil
+	})
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	if len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE {
+		return false, ErrKeySize
+	}
+	b.db.metrics.dels.Add(1)
+	deleted := false
+	err := b.update(func(tx *KVTX, tree *BTree) error {
+		old, exists := tree.Get(key)
+		if !exists {
+			return nil
+		}
+		if old[0] != VAL_PLAIN {
+			return ErrIsBucket
+		}
+		change := Change{Op: OpDel, Bucket: b.Path(), Key: clone(key), Old: clone(old[1:])}
+		deleted = tree.Delete(key)
+		tx.changes = append(tx.changes, change)
+		return nil
+	})
+	return deleted && err == nil, err
+}
+
+// call `fn` for each key from `start` in order until it returns false.
+// `val` is nil for nested buckets. the slices are only valid during the call.
+func (b *Bucket) Scan(start []byte, fn func(key []byte, val []byte) bool) error {
+	b.db.metrics.seeks.Add(1)
+	return b.view(func(tree *BTree) error {
+		for iter := tree.SeekGE(start); iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			if val[0] == VAL_PLAIN {
+				val = val[1:]
+			} else {
+				val = nil
+			}
+			if !fn(key, val) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// call `fn` for each nested bucket name in order until it returns false
+func (b *Bucket) Buckets(fn func(name string) bool) error {
+	return b.view(func(tree *BTree) error {
+		for iter := tree.SeekGE(nil); iter.Valid(); iter.Next() {
+			if key, val := iter.Deref(); val[0] != VAL_PLAIN && !fn(string(key)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bucket) CreateBucket(name string, cmp *Comparator) (*Bucket, error) {
+	path := append(b.Path(), name)
+	if err := checkBucketPath(path); err != nil {
+		return nil, err
+	}
+	if cmp == nil {
+		cmp = Bytewise
+	}
+	if comparators[cmp.Name] != cmp {
+		return nil, fmt.Errorf("%w: %q is not registered", ErrComparator, cmp.Name)
+	}
+	err := b.update(func(tx *KVTX, tree *BTree) error {
+		if _, ok := tree.Get([]byte(name)); ok {
+			return ErrBucketExists
+		}
+		return tree.Insert([]byte(name), storeBucket(&BTree{cmp: cmp}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: b.db, tx: b.tx, path: path}, nil
+}
+
+// remove a nested bucket recursively
+func (b *Bucket) DeleteBucket(name string) error {
+	return b.update(func(tx *KVTX, tree *BTree) error {
+		val, ok := tree.Get([]byte(name))
+		if !ok || val[0] == VAL_PLAIN {
+			return ErrNoBucket
+		}
+		if err := freeBucket(b.db, val); err != nil {
+			return err
+		}
+		tree.Delete([]byte(name))
+		tx.changes = append(tx.changes, Change{Op: OpDropBucket, Bucket: append(b.Path(), name)})
+		return nil
+	})
+}
+
+func (b *Bucket) Bucket(name string) (*Bucket, error) {
+	path := append(b.Path(), name)
+	err := b.view(func(tree *BTree) error {
+		val, ok := tree.Get([]byte(name))
+		if !ok || val[0] == VAL_PLAIN {
+			return ErrNoBucket
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: b.db, tx: b.tx, path: path}, nil
+}
+
+// the catalog as the parent of the top-level buckets
+func (tx *KVTX) root() *Bucket {
+	assert(!tx.done, "transaction already finished")
+	return &Bucket{db: tx.db, tx: tx}
+}
+
+func (db *KV) root() *Bucket {
+	return &Bucket{db: db}
+}
+
+func (tx *KVTX) CreateBucket(name string, cmp *Comparator) (*Bucket, error) {
+	return tx.root().CreateBucket(name, cmp)
+}
+
+// remove a bucket and its nested buckets, and free all their pages
+func (tx *KVTX) DropBucket(name string) error {
+	return tx.root().DeleteBucket(name)
+}
+
+func (tx *KVTX) Bucket(name string) (*Bucket, error) {
+	return tx.root().Bucket(name)
+}
+
+// run `fn` with the top-level buckets of `names`, the missing ones are
+// created. the transaction is committed if `write` and `fn` returns nil,
+// otherwise it is rolled back.
+func (db *KV) WithBuckets(names []string, write bool, fn func(buckets []*Bucket) error) error {
+	tx := db.Begin()
+	buckets := make([]*Bucket, len(names))
+	err := error(nil)
+	for i := 0; i < len(names) && err == nil; i++ {
+		buckets[i], err = tx.Bucket(names[i])
+		if err == ErrNoBucket {
+			buckets[i], err = tx.CreateBucket(names[i], nil)
+		}
+	}
+	if err == nil {
+		err = fn(buckets)
+	}
+	if err != nil || !write {
+		db.Abort(tx)
+		return err
+	}
+	return db.Commit(tx)
+}
+
+// call `fn` for each top-level bucket name in order until it returns false
+func (tx *KVTX) Buckets(fn func(name string) bool) {
+	_ = tx.root().Buckets(fn)
+}
+
+func (db *KV) CreateBucket(name string, cmp *Comparator) (*Bucket, error) {
+	return db.root().CreateBucket(name, cmp)
+}
+
+func (db *KV) DropBucket(name string) error {
+	return db.root().DeleteBucket(name)
+}
+
+func (db *KV) Bucket(name string) (*Bucket, error) {
+	return db.root().Bucket(name)
+}
+
+func (db *KV) Buckets(fn func(name string) bool) {
+	_ = db.root().Buckets(fn)
+}
+
+// visit the trees of all buckets, including nested and inline ones
+func forEachBucket(catalog *BTree, fn func(path []string, tree *BTree) error) error {
+	return forEachNested(catalog, catalog, nil, fn)
+}
+
+func forEachNested(pages *BTree, parent *BTree, path []string, fn func([]string, *BTree) error) error {
+	for iter := parent.SeekGE(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if val[0] == VAL_PLAIN {
+			continue
+		}
+		tree, err := loadBucket(pages, val, false)
+		if err != nil {
+			return err
+		}
+		sub := append(append([]string{}, path...), string(key))
+		if err := fn(sub, &tree); err != nil {
+			return err
+		}
+		if err := forEachNested(pages, &tree, sub, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
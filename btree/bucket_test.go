@@ -0,0 +1,279 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func bucketKeys(t *testing.T, b *Bucket) []string {
+	t.Helper()
+	keys := []string{}
+	err := b.Scan(nil, func(key []byte, val []byte) bool {
+		if len(key) > 0 {
+			keys = append(keys, string(key))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func mustGet(t *testing.T, b *Bucket, key string, want string) {
+	t.Helper()
+	val, ok, err := b.Get([]byte(key))
+	if err != nil || !ok || string(val) != want {
+		t.Fatalf("%v %q: got %q %v %v, want %q", b.Path(), key, val, ok, err, want)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path})
+	a, err := db.CreateBucket("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateBucket("a", nil); !errors.Is(err, ErrBucketExists) {
+		t.Fatalf("create twice: %v", err)
+	}
+	ab, err := a.CreateBucket("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abc, err := ab.CreateBucket("c", Reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(abc.Path()) != "[a b c]" || abc.Name() != "c" {
+		t.Fatalf("path %v", abc.Path())
+	}
+	// the same key in each bucket and the default keyspace
+	for i, b := range []*Bucket{a, ab, abc} {
+		for _, key := range []string{"k1", "k2", "k3"} {
+			if err := b.Set([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Set([]byte("k1"), []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	// a nested bucket is not a value
+	if err := a.Set([]byte("b"), []byte("x")); !errors.Is(err, ErrIsBucket) {
+		t.Fatalf("set over a bucket: %v", err)
+	}
+	if _, _, err := a.Get([]byte("b")); !errors.Is(err, ErrIsBucket) {
+		t.Fatalf("get a bucket: %v", err)
+	}
+	if _, err := a.Del([]byte("b")); !errors.Is(err, ErrIsBucket) {
+		t.Fatalf("del a bucket: %v", err)
+	}
+	if _, err := a.Bucket("k1"); !errors.Is(err, ErrNoBucket) {
+		t.Fatalf("a value as a bucket: %v", err)
+	}
+	if _, err := db.Bucket("missing"); !errors.Is(err, ErrNoBucket) {
+		t.Fatalf("missing bucket: %v", err)
+	}
+	if _, err := a.CreateBucket("", nil); !errors.Is(err, ErrKeySize) {
+		t.Fatalf("empty name: %v", err)
+	}
+	if _, err := a.Del([]byte("k2")); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, db)
+
+	// reopen and find the buckets by path
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openKV(t, &KV{Path: path})
+	if val, _ := db.Get([]byte("k1")); string(val) != "default" {
+		t.Fatalf("default keyspace: %q", val)
+	}
+	if a, err = db.Bucket("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ab, err = a.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if abc, err = ab.Bucket("c"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := bucketKeys(t, a); fmt.Sprint(keys) != "[b k1 k3]" {
+		t.Fatalf("a: %q", keys)
+	}
+	if keys := bucketKeys(t, abc); fmt.Sprint(keys) != "[k3 k2 k1]" {
+		t.Fatalf("a/b/c in reverse: %q", keys)
+	}
+	mustGet(t, ab, "k2", "1")
+	mustGet(t, abc, "k1", "2")
+	names := []string{}
+	db.Buckets(func(name string) bool { names = append(names, name); return true })
+	if fmt.Sprint(names) != "[a]" {
+		t.Fatalf("buckets %q", names)
+	}
+
+	// delete a nested bucket, then the top-level one
+	if err := a.DeleteBucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Bucket("b"); !errors.Is(err, ErrNoBucket) {
+		t.Fatalf("deleted bucket: %v", err)
+	}
+	if _, _, err := abc.Get([]byte("k1")); !errors.Is(err, ErrNoBucket) {
+		t.Fatalf("handle of a deleted bucket: %v", err)
+	}
+	mustGet(t, a, "k1", "0")
+	if err := db.DropBucket("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("a"); !errors.Is(err, ErrNoBucket) {
+		t.Fatalf("drop twice: %v", err)
+	}
+	checkPages(t, db)
+}
+
+// the value of a top-level bucket in the catalog
+func catalogVal(db *KV, name string) []byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	val, _ := db.catalog.Get([]byte(name))
+	return clone(val)
+}
+
+func TestBucketInline(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	b, err := db.CreateBucket("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catalogVal(db, "b")[0] != VAL_INLINE {
+		t.Fatal("a new bucket is not inline")
+	}
+	stats := checkPages(t, db)
+	pages := stats.TreePages()
+	// grow until the leaf doesn't fit inline
+	n := 0
+	for catalogVal(db, "b")[0] == VAL_INLINE {
+		if err := b.Set([]byte(fmt.Sprintf("key%04d", n)), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if n > BUCKET_INLINE_MAX {
+			t.Fatal("never stored in a page")
+		}
+	}
+	if val := catalogVal(db, "b"); val[0] != VAL_BUCKET {
+		t.Fatalf("bucket type %d", val[0])
+	}
+	stats = checkPages(t, db)
+	if got := stats.TreePages(); got != pages+1 {
+		t.Fatalf("%d tree pages, want %d", got, pages+1)
+	}
+	// an inline bucket is at most BUCKET_INLINE_MAX bytes
+	b2, _ := db.CreateBucket("b2", nil)
+	for i := 0; i < n-1; i++ {
+		_ = b2.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("0123456789"))
+	}
+	if val := catalogVal(db, "b2"); val[0] != VAL_INLINE || len(val) > 2+len("bytewise")+BUCKET_INLINE_MAX {
+		t.Fatalf("inline bucket of %d bytes", len(val))
+	}
+	// and back to inline after deletions
+	if _, err := b.Del([]byte("key0000")); err != nil {
+		t.Fatal(err)
+	}
+	if catalogVal(db, "b")[0] != VAL_INLINE {
+		t.Fatal("a small bucket is not inline")
+	}
+	checkPages(t, db)
+	keys := bucketKeys(t, b)
+	if len(keys) != n-1 || !slices.IsSorted(keys) {
+		t.Fatalf("%d keys", len(keys))
+	}
+}
+
+func TestDropBucketFreesPages(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	setKeys(t, db, 100, "default")
+	before := checkPages(t, db)
+	b, err := db.CreateBucket("big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CreateBucket("nested", nil); err != nil {
+		t.Fatal(err)
+	}
+	small, err := b.CreateBucket("small", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = small.Set([]byte("k"), []byte("v")) // inline
+	tx := db.Begin()
+	tb, _ := tx.Bucket("big")
+	tn, _ := tb.Bucket("nested")
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := tb.Set(key, []byte(testVal(i, 100))); err != nil {
+			t.Fatal(err)
+		}
+		if err := tn.Set(key, []byte(testVal(i, 50))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	grown := checkPages(t, db)
+	if grown.TreePages() < before.TreePages()+100 {
+		t.Fatalf("%d tree pages after filling the buckets", grown.TreePages())
+	}
+	if err := db.DropBucket("big"); err != nil {
+		t.Fatal(err)
+	}
+	after := checkPages(t, db)
+	// the empty catalog may keep a root
+	if after.Catalog.Pages() > 1 || after.TreePages()-after.Catalog.Pages() != before.TreePages() {
+		t.Fatalf("%d tree pages after the drop, %d before", after.TreePages(), before.TreePages())
+	}
+	if len(after.Buckets) != 0 {
+		t.Fatalf("buckets left: %+v", after.Buckets)
+	}
+
+	// create, fill and drop in one transaction
+	tx = db.Begin()
+	tb, err = tx.CreateBucket("tmp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn, err = tb.CreateBucket("nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := tb.Set(key, []byte(testVal(i, 100))); err != nil {
+			t.Fatal(err)
+		}
+		if err := tn.Set(key, []byte(testVal(i, 50))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	after = checkPages(t, db)
+	if after.TreePages()-after.Catalog.Pages() != before.TreePages() {
+		t.Fatalf("%d tree pages after the drop, %d before", after.TreePages(), before.TreePages())
+	}
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
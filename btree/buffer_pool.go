@@ -0,0 +1,127 @@
+package btree
+
+import (
+	"sync"
+)
+
+const DEFAULT_CACHE_SIZE = 64 << 20
+
+type PoolStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int // cached pages
+	Capacity  int // max cached pages
+}
+
+// A cache of written pages with CLOCK eviction. Pages are copy-on-write, so
+// a cached page only changes when a freed page is reused, and the writer
+// replaces it then. An evicted page is only dropped from the cache, the
+// callers may still hold it.
+type bufferPool struct {
+	mu     sync.Mutex // snapshots read concurrently with the writer
+	frames []poolFrame
+	index  map[uint64]int // ptr => frame
+	hand   int
+	stats  PoolStats
+}
+
+type poolFrame struct {
+	ptr  uint64
+	page []byte
+	ref  bool // used since the last sweep of the hand
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DEFAULT_CACHE_SIZE
+	}
+	capacity := max(size/BTREE_PAGE_SIZE, 8)
+	return &bufferPool{
+		frames: make([]poolFrame, 0, capacity),
+		index:  map[uint64]int{},
+		stats:  PoolStats{Capacity: capacity},
+	}
+}
+
+// a cached page or nil
+func (pool *bufferPool) get(ptr uint64) BNode {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	i, ok := pool.index[ptr]
+	if !ok {
+		pool.stats.Misses++
+		return nil
+	}
+	pool.frames[i].ref = true
+	pool.stats.Hits++
+	return pool.frames[i].page
+}
+
+// add or replace a page
+func (pool *bufferPool) put(ptr uint64, page []byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if i, ok := pool.index[ptr]; ok {
+		pool.frames[i].page = page
+		pool.frames[i].ref = true
+		return
+	}
+	if len(pool.frames) < cap(pool.frames) {
+		pool.index[ptr] = len(pool.frames)
+		pool.frames = append(pool.frames, poolFrame{ptr: ptr, page: page})
+		return
+	}
+	// evict the 1st page that is not used since the last sweep
+	for pool.frames[pool.hand].ref {
+		pool.frames[pool.hand].ref = false
+		pool.hand = (pool.hand + 1) % len(pool.frames)
+	}
+	victim := &pool.frames[pool.hand]
+	delete(pool.index, victim.ptr)
+	pool.stats.Evictions++
+	*victim = poolFrame{ptr: ptr, page: page}
+	pool.index[ptr] = pool.hand
+	pool.hand = (pool.hand + 1) % len(pool.frames)
+}
+
+// drop the cached pages from `npages`, and their frames so that the slots
+// are filled before anything is evicted
+func (pool *bufferPool) invalidate(npages uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	live, hand := pool.frames[:0], 0
+	for i, frame := range pool.frames {
+		if frame.ptr >= npages {
+			delete(pool.index, frame.ptr)
+			continue
+		}
+		if i < pool.hand {
+			hand++ // the hand stays on the same frame
+		}
+		pool.index[frame.ptr] = len(live)
+		live = append(live, frame)
+	}
+	clear(pool.frames[len(live):]) // release the pages
+	pool.frames = live
+	pool.hand = hand
+	if pool.hand >= len(live) {
+		pool.hand = 0
+	}
+}
+
+func (pool *bufferPool) getStats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	stats := pool.stats
+	stats.Pages = len(pool.index)
+	return stats
+}
+
+// the buffer pool counters, zero without a pool
+func (db *KV) PoolStats() PoolStats {
+	if store, ok := baseStore(db.store).(*preadStore); ok {
+		return store.pool.getStats()
+	}
+	return PoolStats{}
+}
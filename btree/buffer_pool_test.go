@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func poolPage(ptr uint64) []byte {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	page[0] = byte(ptr)
+	return page
+}
+
+func checkCached(t *testing.T, pool *bufferPool, cached []uint64, evicted []uint64) {
+	t.Helper()
+	for _, ptr := range cached {
+		if _, ok := pool.index[ptr]; !ok {
+			t.Fatalf("page %d is not cached", ptr)
+		}
+	}
+	for _, ptr := range evicted {
+		if _, ok := pool.index[ptr]; ok {
+			t.Fatalf("page %d is cached", ptr)
+		}
+	}
+}
+
+func TestBufferPoolClock(t *testing.T) {
+	pool := newBufferPool(8 * BTREE_PAGE_SIZE)
+	for ptr := uint64(0); ptr < 8; ptr++ {
+		pool.put(ptr, poolPage(ptr))
+	}
+	for _, ptr := range []uint64{0, 1, 2, 5} {
+		if page := pool.get(ptr); page == nil || page[0] != byte(ptr) {
+			t.Fatalf("get %d: %v", ptr, page)
+		}
+	}
+	if pool.get(100) != nil {
+		t.Fatal("get an uncached page")
+	}
+	stats := pool.getStats()
+	if stats.Hits != 4 || stats.Misses != 1 || stats.Evictions != 0 || stats.Pages != 8 || stats.Capacity != 8 {
+		t.Fatalf("stats %+v", stats)
+	}
+	// the used pages get a second chance
+	pool.put(8, poolPage(8))
+	checkCached(t, pool, []uint64{0, 1, 2, 8}, []uint64{3})
+	pool.put(9, poolPage(9))
+	checkCached(t, pool, []uint64{5}, []uint64{4})
+	pool.put(10, poolPage(10))
+	checkCached(t, pool, []uint64{5}, []uint64{6})
+	pool.put(11, poolPage(11))
+	pool.put(12, poolPage(12))
+	checkCached(t, pool, []uint64{1, 2, 5}, []uint64{0, 7})
+	// replacing a page doesn't evict
+	pool.put(12, poolPage(13))
+	if page := pool.get(12); page[0] != 13 {
+		t.Fatalf("replaced page %d", page[0])
+	}
+	stats = pool.getStats()
+	if stats.Evictions != 5 || stats.Pages != 8 || stats.Hits != 5 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBufferPoolInvalidate(t *testing.T) {
+	pool := newBufferPool(8 * BTREE_PAGE_SIZE)
+	for ptr := uint64(0); ptr < 8; ptr++ {
+		pool.put(ptr, poolPage(ptr))
+	}
+	pool.put(8, poolPage(8)) // moves the hand
+	pool.invalidate(4)
+	if stats := pool.getStats(); stats.Pages != 3 || len(pool.frames) != 3 {
+		t.Fatalf("after invalidate: %+v, %d frames", stats, len(pool.frames))
+	}
+	// the freed slots are used before anything is evicted
+	for ptr := uint64(4); ptr < 9; ptr++ {
+		pool.put(ptr, poolPage(ptr+10))
+	}
+	stats := pool.getStats()
+	if stats.Pages != 8 || stats.Evictions != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	for ptr := uint64(4); ptr < 9; ptr++ {
+		if page := pool.get(ptr); page == nil || page[0] != byte(ptr+10) {
+			t.Fatalf("page %d: %v", ptr, page)
+		}
+	}
+	for i, frame := range pool.frames {
+		if pool.index[frame.ptr] != i {
+			t.Fatalf("frame %d of page %d", i, frame.ptr)
+		}
+	}
+}
+
+func TestBufferPoolKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path, IO: IO_PREAD, CacheSize: 16 * BTREE_PAGE_SIZE})
+	val := strings.Repeat("v", 200)
+	setKeys(t, db, 2000, val)
+	for i := 0; i < 2000; i++ {
+		if got, ok := db.Get([]byte(fmt.Sprintf("key%04d", i))); !ok || string(got) != val {
+			t.Fatalf("get %d", i)
+		}
+	}
+	stats := db.PoolStats()
+	if stats.Capacity != 16 || stats.Pages != 16 || stats.Hits == 0 || stats.Misses == 0 || stats.Evictions == 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,282 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The change log is a separate B-tree whose root is in the meta page.
+// Committed changes are only logged while there are subscribers, and
+// entries are trimmed once every subscriber has acknowledged them.
+//
+// The key format:
+// | 0x01 | name                              | ==> acknowledged seq (8B)
+// | 0x02 | seq (8B) | idx (4B) | field (1B) | ==> field data
+//
+// A change is split into fields so that each one fits in a single value:
+// the op and the key, the old value (if any), the new value (if any),
+// and the bucket path (if not the default keyspace).
+const (
+	LOG_CURSOR = 1
+	LOG_ENTRY  = 2
+)
+
+const (
+	logFieldKey    = 0
+	logFieldOld    = 1
+	logFieldNew    = 2
+	logFieldBucket = 3
+)
+
+type ChangeOp byte
+
+const (
+	OpPut        ChangeOp = 1
+	OpDel        ChangeOp = 2
+	OpDropBucket ChangeOp = 3 // all keys of the bucket are deleted
+)
+
+// a committed mutation; `Old` is nil if the key did not exist before.
+// `Bucket` is the path of nested bucket names, empty for the default keyspace.
+type Change struct {
+	Op     ChangeOp
+	Bucket []string
+	Key    []byte
+	Old    []byte
+	New    []byte
+}
+
+// the changes of a committed transaction
+type ChangeSet struct {
+	Seq     uint64
+	Changes []Change
+}
+
+type changeLog struct {
+	tree   BTree
+	notify chan struct{} // closed on every commit with changes
+}
+
+var (
+	ErrSubscriber  = errors.New("unknown subscriber")
+	ErrUndelivered = errors.New("ack of an undelivered seq")
+)
+
+func logCursorKey(name string) []byte {
+	return append([]byte{LOG_CURSOR}, name...)
+}
+
+func logEntryKey(seq uint64, idx uint32, field byte) []byte {
+	key := make([]byte, 1+8+4+1)
+	key[0] = LOG_ENTRY
+	binary.BigEndian.PutUint64(key[1:], seq)
+	binary.BigEndian.PutUint32(key[9:], idx)
+	key[13] = field
+	return key
+}
+
+// any registered subscribers?
+func logActive(db *KV) bool {
+	iter := db.cdc.tree.SeekGE([]byte{LOG_CURSOR})
+	if !iter.Valid() {
+		return false
+	}
+	key, _ := iter.Deref()
+	return key[0] == LOG_CURSOR
+}
+
+// the smallest acknowledged seq of all subscribers
+func logMinCursor(db *KV) (uint64, bool) {
+	min, found := uint64(0), false
+	for iter := db.cdc.tree.SeekGE([]byte{LOG_CURSOR}); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if key[0] != LOG_CURSOR {
+			break
+		}
+		if seq := binary.LittleEndian.Uint64(val); !found || seq < min {
+			min, found = seq, true
+		}
+	}
+	return min, found
+}
+
+// add the changes of a commit to the log
+func logChanges(db *KV, seq uint64, changes []Change) error {
+	if !logActive(db) {
+		return nil
+	}
+	for i, c := range changes {
+		fields := map[byte][]byte{logFieldKey: append([]byte{byte(c.Op)}, c.Key...)}
+		if c.Old != nil {
+			fields[logFieldOld] = c.Old
+		}
+		if c.Op == OpPut {
+			fields[logFieldNew] = c.New
+		}
+		if len(c.Bucket) > 0 {
+			fields[logFieldBucket] = encodePath(c.Bucket)
+		}
+		for field, val := range fields {
+			if err := db.cdc.tree.Insert(logEntryKey(seq, uint32(i), field), val); err != nil {
+				return fmt.Errorf("change log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// remove entries that are acknowledged by all subscribers
+func logTrim(db *KV) {
+	upto, found := logMinCursor(db)
+	if !found {
+		upto = db.seq // no subscribers, drop everything
+	}
+	keys := [][]byte{}
+	for iter := db.cdc.tree.SeekGE([]byte{LOG_ENTRY}); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if binary.BigEndian.Uint64(key[1:]) > upto {
+			break
+		}
+		keys = append(keys, clone(key))
+	}
+	for _, key := range keys {
+		db.cdc.tree.Delete(key)
+	}
+}
+
+// read the change set that follows `after`
+func logRead(db *KV, after uint64) (ChangeSet, bool) {
+	iter := db.cdc.tree.SeekGE(logEntryKey(after+1, 0, 0))
+	if !iter.Valid() {
+		return ChangeSet{}, false
+	}
+	key, _ := iter.Deref()
+	if key[0] != LOG_ENTRY {
+		return ChangeSet{}, false
+	}
+	set := ChangeSet{Seq: binary.BigEndian.Uint64(key[1:])}
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if binary.BigEndian.Uint64(key[1:]) != set.Seq {
+			break
+		}
+		switch key[13] {
+		case logFieldKey:
+			set.Changes = append(set.Changes, Change{Op: ChangeOp(val[0]), Key: clone(val[1:])})
+		case logFieldOld:
+			set.Changes[len(set.Changes)-1].Old = clone(val)
+		case logFieldNew:
+			set.Changes[len(set.Changes)-1].New = clone(val)
+		case logFieldBucket:
+			set.Changes[len(set.Changes)-1].Bucket = decodePath(val)
+		}
+	}
+	return set, true
+}
+
+// bucket names prefixed with 2-byte lengths
+func encodePath(path []string) []byte {
+	out := []byte{}
+	for _, name := range path {
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(name)))
+		out = append(out, name...)
+	}
+	return out
+}
+
+func decodePath(data []byte) []string {
+	path := []string{}
+	for len(data) >= 2 {
+		n := int(binary.LittleEndian.Uint16(data))
+		path = append(path, string(data[2:2+n]))
+		data = data[2+n:]
+	}
+	return path
+}
+
+// a persistent consumer of the change log
+type Subscription struct {
+	db   *KV
+	name string
+	pos  uint64 // the last delivered seq
+}
+
+// register a subscriber or resume from its last acknowledged seq.
+// a new subscriber starts from the next commit.
+func (db *KV) Subscribe(name string) (*Subscription, error) {
+	if len(name) == 0 || 1+len(name) > BTREE_MAX_KEY_SIZE {
+		return nil, ErrKeySize
+	}
+	tx := db.Begin()
+	sub := &Subscription{db: db, name: name, pos: db.seq}
+	if val, ok := db.cdc.tree.Get(logCursorKey(name)); ok {
+		sub.pos = binary.LittleEndian.Uint64(val)
+		db.Abort(tx)
+		return sub, nil
+	}
+	if err := setCursor(db, name, sub.pos); err != nil {
+		db.Abort(tx)
+		return nil, err
+	}
+	if err := db.Commit(tx); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// remove a subscriber and the log entries that are no longer needed
+func (db *KV) Unsubscribe(name string) error {
+	tx := db.Begin()
+	if !db.cdc.tree.Delete(logCursorKey(name)) {
+		db.Abort(tx)
+		return ErrSubscriber
+	}
+	logTrim(db)
+	return db.Commit(tx)
+}
+
+func setCursor(db *KV, name string, seq uint64) error {
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], seq)
+	return db.cdc.tree.Insert(logCursorKey(name), val[:])
+}
+
+// the next committed change set after the last delivered one
+func (sub *Subscription) Next() (ChangeSet, bool) {
+	sub.db.mu.Lock()
+	defer sub.db.mu.Unlock()
+	set, ok := logRead(sub.db, sub.pos)
+	if ok {
+		sub.pos = set.Seq
+	}
+	return set, ok
+}
+
+// a channel that is closed on the next commit with changes;
+// obtain it before calling `Next` to avoid missing a wakeup.
+func (sub *Subscription) Wait() <-chan struct{} {
+	sub.db.mu.Lock()
+	defer sub.db.mu.Unlock()
+	return sub.db.cdc.notify
+}
+
+// persist the cursor, changes up to `seq` will not be delivered again
+func (sub *Subscription) Ack(seq uint64) error {
+	db := sub.db
+	tx := db.Begin()
+	if seq > sub.pos {
+		db.Abort(tx)
+		return fmt.Errorf("%w: %d, delivered %d", ErrUndelivered, seq, sub.pos)
+	}
+	if _, ok := db.cdc.tree.Get(logCursorKey(sub.name)); !ok {
+		db.Abort(tx)
+		return ErrSubscriber
+	}
+	if err := setCursor(db, sub.name, seq); err != nil {
+		db.Abort(tx)
+		return err
+	}
+	logTrim(db)
+	return db.Commit(tx)
+}
@@ -0,0 +1,143 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func nextChanges(t *testing.T, sub *Subscription) ChangeSet {
+	t.Helper()
+	set, ok := sub.Next()
+	if !ok {
+		t.Fatal("no change set")
+	}
+	return set
+}
+
+func TestChangeLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path})
+	if err := db.Set([]byte("k0"), []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.Next(); ok {
+		t.Fatal("a new subscriber starts from the next commit")
+	}
+	// 3 commits in order
+	tx := db.Begin()
+	for i := 0; i < 3; i++ {
+		_ = tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Del([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k2"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	set := nextChanges(t, sub)
+	if len(set.Changes) != 3 {
+		t.Fatalf("got %d changes", len(set.Changes))
+	}
+	for i, c := range set.Changes {
+		if c.Op != OpPut || string(c.Key) != fmt.Sprintf("k%d", i) || string(c.New) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("change %d: %+v", i, c)
+		}
+	}
+	if string(set.Changes[0].Old) != "before" || set.Changes[1].Old != nil {
+		t.Fatalf("old values: %+v", set.Changes)
+	}
+	first := set.Seq
+	set = nextChanges(t, sub)
+	if set.Seq != first+1 || set.Changes[0].Op != OpDel || string(set.Changes[0].Old) != "v1" {
+		t.Fatalf("delete: %+v", set)
+	}
+	set = nextChanges(t, sub)
+	if set.Seq != first+2 || string(set.Changes[0].Old) != "v2" || string(set.Changes[0].New) != "new" {
+		t.Fatalf("update: %+v", set)
+	}
+	if _, ok := sub.Next(); ok {
+		t.Fatal("unexpected change set")
+	}
+
+	// only delivered seqs can be acknowledged
+	if err := sub.Ack(first + 3); !errors.Is(err, ErrUndelivered) {
+		t.Fatalf("ack: %v", err)
+	}
+	if err := sub.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// resume after the acknowledged seq
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openKV(t, &KV{Path: path})
+	sub, err = db.Subscribe("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set = nextChanges(t, sub); set.Seq != first+1 {
+		t.Fatalf("resumed at %d, want %d", set.Seq, first+1)
+	}
+	nextChanges(t, sub)
+	if err := sub.Ack(first + 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unsubscribe("index"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unsubscribe("index"); !errors.Is(err, ErrSubscriber) {
+		t.Fatalf("unsubscribe twice: %v", err)
+	}
+}
+
+func TestChangeLogWait(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	sub, err := db.Subscribe("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const N = 20
+	got := make(chan uint64)
+	go func() {
+		defer close(got)
+		for n := 0; n < N; {
+			wait := sub.Wait()
+			set, ok := sub.Next()
+			if !ok {
+				<-wait
+				continue
+			}
+			got <- set.Seq
+			n++
+		}
+	}()
+	for i := 0; i < N; i++ {
+		if err := db.Set([]byte("key"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := uint64(0)
+	for i := 0; i < N; i++ {
+		select {
+		case seq := <-got:
+			if seq <= last {
+				t.Fatalf("seq %d after %d", seq, last)
+			}
+			last = seq
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no wakeup after %d change sets", i)
+		}
+	}
+}
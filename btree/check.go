@@ -0,0 +1,131 @@
+package btree
+
+import (
+	"fmt"
+)
+
+// verify the structure of a tree: node types and sizes, key order,
+// separator keys, and that all leaves are at the same depth.
+func (tree *BTree) Check() (err error) {
+	if tree.root == 0 {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupted node: %v", r)
+		}
+	}()
+	_, err = checkNode(tree, tree.root, nil, nil)
+	return err
+}
+
+// check a subtree whose keys are in [first, next), return its height
+func checkNode(tree *BTree, ptr uint64, first []byte, next []byte) (int, error) {
+	node := BNode(tree.get(ptr))
+	fail := func(format string, args ...any) (int, error) {
+		return 0, fmt.Errorf("page %d: %s", ptr, fmt.Sprintf(format, args...))
+	}
+	btype, nkeys := node.btype(), node.nkeys()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fail("bad node type %d", btype)
+	}
+	if nkeys == 0 {
+		return fail("empty node")
+	}
+	if BNODE_HEADER+10*int(nkeys) > BTREE_NODE_MAX || node.nbytes() > BTREE_NODE_MAX {
+		return fail("node too big")
+	}
+	// the first key is the separator in the parent, or the dummy key
+	if tree.compare(node.getKey(0), first) != 0 {
+		return fail("first key %q is not the separator %q", node.getKey(0), first)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		key, val := node.getKey(i), node.getVal(i)
+		if i > 0 && (len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE) {
+			return fail("bad key size %d at %d", len(key), i)
+		}
+		if len(val) > BTREE_MAX_VAL_SIZE || (btype == BNODE_NODE && len(val) > 0) {
+			return fail("bad value size %d at %d", len(val), i)
+		}
+		if i > 0 && tree.compare(node.getKey(i-1), key) >= 0 {
+			return fail("key %q at %d is out of order", key, i)
+		}
+		if next != nil && tree.compare(key, next) >= 0 {
+			return fail("key %q at %d is not below the next separator %q", key, i, next)
+		}
+	}
+	if btype == BNODE_LEAF {
+		return 1, nil
+	}
+	height := 0
+	for i := uint16(0); i < nkeys; i++ {
+		kidNext := next
+		if i+1 < nkeys {
+			kidNext = node.getKey(i + 1)
+		}
+		h, err := checkNode(tree, node.getPtr(i), node.getKey(i), kidNext)
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 && h != height {
+			return fail("unbalanced kids")
+		}
+		height = h
+	}
+	return height + 1, nil
+}
+
+// verify the trees of the last committed version
+func (db *KV) Check() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.tree.Check(); err != nil {
+		return fmt.Errorf("tree: %w", err)
+	}
+	if err := db.cdc.tree.Check(); err != nil {
+		return fmt.Errorf("change log: %w", err)
+	}
+	if err := db.catalog.Check(); err != nil {
+		return fmt.Errorf("bucket catalog: %w", err)
+	}
+	if err := checkFreeLists(&db.free, &db.held); err != nil {
+		return fmt.Errorf("free list: %w", err)
+	}
+	return forEachBucket(&db.catalog, func(path []string, tree *BTree) error {
+		if err := tree.Check(); err != nil {
+			return fmt.Errorf("bucket %q: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// a page is listed at most once, as a list node or as a free page,
+// in any of the lists
+func checkFreeLists(lists ...*FreeList) error {
+	seen := map[uint64]bool{}
+	add := func(ptr uint64) error {
+		if ptr == 0 || seen[ptr] {
+			return fmt.Errorf("page %d is listed twice", ptr)
+		}
+		seen[ptr] = true
+		return nil
+	}
+	for _, fl := range lists {
+		for ptr := fl.head; ptr != 0; {
+			if err := add(ptr); err != nil {
+				return err
+			}
+			node := fl.get(ptr)
+			for i := 0; i < flnSize(node); i++ {
+				run := flnRun(node, i)
+				for j := uint64(0); j < run.count; j++ {
+					if err := add(run.start + j); err != nil {
+						return err
+					}
+				}
+			}
+			ptr = flnNext(node)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// The key order of a tree. It is persisted by name, so a DB can't be
+// reopened with a different one. Keys that compare equal are the same key.
+type Comparator struct {
+	Name    string
+	Compare func(a, b []byte) int
+}
+
+const MAX_COMPARATOR_NAME = 32
+
+var ErrComparator = errors.New("comparator mismatch")
+
+var (
+	Bytewise        = &Comparator{"bytewise", bytes.Compare}
+	Reverse         = &Comparator{"reverse", func(a, b []byte) int { return bytes.Compare(b, a) }}
+	CaseInsensitive = &Comparator{"case-insensitive", compareFold}
+	Numeric         = &Comparator{"numeric", compareNumeric}
+)
+
+// comparators that can be found by their persisted names
+var comparators = map[string]*Comparator{}
+
+func init() {
+	for _, cmp := range []*Comparator{Bytewise, Reverse, CaseInsensitive, Numeric} {
+		RegisterComparator(cmp)
+	}
+}
+
+// make a custom comparator usable for buckets
+func RegisterComparator(cmp *Comparator) {
+	assert(len(cmp.Name) > 0 && len(cmp.Name) <= MAX_COMPARATOR_NAME, "bad comparator name")
+	assert(comparators[cmp.Name] == nil, "duplicated comparator")
+	comparators[cmp.Name] = cmp
+}
+
+func (tree *BTree) compare(a, b []byte) int {
+	// the dummy empty key comes first in any order
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) - len(b)
+	}
+	if tree.cmp == nil {
+		return bytes.Compare(a, b)
+	}
+	return tree.cmp.Compare(a, b)
+}
+
+func comparatorName(cmp *Comparator) string {
+	if cmp == nil {
+		return Bytewise.Name
+	}
+	return cmp.Name
+}
+
+// ASCII case folding
+func compareFold(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lower(a[i]), lower(b[i])
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return len(a) - len(b)
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// decimal integers of any length, e.g. "-12" < "9" < "010";
+// other keys come after them in bytewise order.
+func compareNumeric(a, b []byte) int {
+	nega, da, oka := parseDecimal(a)
+	negb, db, okb := parseDecimal(b)
+	switch {
+	case oka && !okb:
+		return -1
+	case !oka && okb:
+		return 1
+	case !oka && !okb:
+		return bytes.Compare(a, b)
+	}
+	if nega != negb {
+		if nega {
+			return -1
+		}
+		return 1
+	}
+	c := len(da) - len(db)
+	if c == 0 {
+		c = bytes.Compare(da, db)
+	}
+	if nega {
+		c = -c
+	}
+	return c
+}
+
+// the sign and the digits without leading zeros
+func parseDecimal(key []byte) (bool, []byte, bool) {
+	neg := len(key) > 0 && key[0] == '-'
+	if neg {
+		key = key[1:]
+	}
+	if len(key) == 0 {
+		return false, nil, false
+	}
+	for _, c := range key {
+		if c < '0' || '9' < c {
+			return false, nil, false
+		}
+	}
+	key = bytes.TrimLeft(key, "0")
+	return neg && len(key) > 0, key, true // -0 is 0
+}
@@ -0,0 +1,178 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareNumeric(t *testing.T) {
+	// in ascending order, equal keys in the same group
+	order := [][]string{
+		{"-100"},
+		{"-12", "-012"},
+		{"-9"},
+		{"0", "-0", "000", "-000"},
+		{"9", "09"},
+		{"12", "0012"},
+		{"100"},
+		{"99999999999999999999999"}, // longer than an int64
+		{"-"},                       // not numbers, in bytewise order
+		{"1.5"},
+		{"10a"},
+		{"a"},
+	}
+	for i, group := range order {
+		for _, a := range group {
+			for j, other := range order {
+				for _, b := range other {
+					got := compareNumeric([]byte(a), []byte(b))
+					want := i - j
+					if (got < 0) != (want < 0) || (got == 0) != (want == 0) {
+						t.Fatalf("compare(%q, %q) = %d", a, b, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCompareFold(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"abc", "ABC", 0},
+		{"Abc", "abd", -1},
+		{"ab", "ABC", -1},
+		{"a_", "A[", 1}, // '_' > '[', and not case folded
+		{"\xc3\x84", "\xc3\xa4", -1},
+	} {
+		got := compareFold([]byte(c.a), []byte(c.b))
+		if (got < 0) != (c.want < 0) || (got == 0) != (c.want == 0) {
+			t.Fatalf("compare(%q, %q) = %d", c.a, c.b, got)
+		}
+	}
+}
+
+// random operations on a tree with a comparator, checked against the
+// keys that the comparator considers distinct
+func TestComparatorTrees(t *testing.T) {
+	keyGen := map[string]func(*rand.Rand) string{
+		"reverse": func(rng *rand.Rand) string { return fmt.Sprintf("key%05d", rng.Intn(3000)) },
+		"case-insensitive": func(rng *rand.Rand) string {
+			key := []byte(fmt.Sprintf("key%05d", rng.Intn(3000)))
+			for i := range key {
+				if 'a' <= key[i] && key[i] <= 'z' && rng.Intn(2) == 0 {
+					key[i] -= 'a' - 'A'
+				}
+			}
+			return string(key)
+		},
+		"numeric": func(rng *rand.Rand) string {
+			n := rng.Intn(6000) - 3000
+			return fmt.Sprintf("%0*d", rng.Intn(4), n)
+		},
+	}
+	for _, cmp := range []*Comparator{Reverse, CaseInsensitive, Numeric} {
+		t.Run(cmp.Name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			c := NewC()
+			c.tree = NewBTree(cmp, c.tree.get, c.tree.new, c.tree.del)
+			ref := map[string]string{} // the first inserted form of a key
+			find := func(key string) (string, bool) {
+				for k := range ref {
+					if cmp.Compare([]byte(k), []byte(key)) == 0 {
+						return k, true
+					}
+				}
+				return "", false
+			}
+			for i := 0; i < 3000; i++ {
+				key := keyGen[cmp.Name](rng)
+				old, exists := find(key)
+				if rng.Intn(3) == 0 {
+					if c.tree.Delete([]byte(key)) != exists {
+						t.Fatalf("delete %q: exists %v", key, exists)
+					}
+					delete(ref, old)
+					continue
+				}
+				val := testVal(i, rng.Intn(200))
+				c.tree.Insert([]byte(key), []byte(val))
+				if exists {
+					key = old // the same key in another form
+				}
+				ref[key] = val
+			}
+			if err := c.tree.Check(); err != nil {
+				t.Fatal(err)
+			}
+			var prev []byte
+			n := 0
+			for iter := c.tree.SeekGE(nil); iter.Valid(); iter.Next() {
+				key, val := iter.Deref()
+				if prev != nil && cmp.Compare(prev, key) >= 0 {
+					t.Fatalf("%q before %q", prev, key)
+				}
+				got, ok := find(string(key))
+				if !ok || ref[got] != string(val) {
+					t.Fatalf("key %q", key)
+				}
+				prev = key
+				n++
+			}
+			if n != len(ref) {
+				t.Fatalf("%d keys, ref %d", n, len(ref))
+			}
+		})
+	}
+}
+
+func TestComparatorReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path, Comparator: Numeric})
+	for _, key := range []string{"10", "9", "-1", "x"} {
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := db.CreateBucket("names", CaseInsensitive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("Alice"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmp := range []*Comparator{nil, Bytewise, Reverse} {
+		err := (&KV{Path: path, Comparator: cmp}).Open()
+		if !errors.Is(err, ErrComparator) {
+			t.Fatalf("reopen with %s: %v", comparatorName(cmp), err)
+		}
+	}
+	db = openKV(t, &KV{Path: path, Comparator: Numeric})
+	keys := []string{}
+	tx := db.Begin()
+	for iter := tx.Seek(nil); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if len(key) > 0 {
+			keys = append(keys, string(key))
+		}
+	}
+	db.Abort(tx)
+	if fmt.Sprint(keys) != "[-1 9 10 x]" {
+		t.Fatalf("keys %q", keys)
+	}
+	// the bucket keeps its own order
+	if b, err = db.Bucket("names"); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := b.Get([]byte("ALICE")); err != nil || !ok || string(val) != "1" {
+		t.Fatalf("case-insensitive get: %q %v %v", val, ok, err)
+	}
+}
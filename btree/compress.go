@@ -0,0 +1,104 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Values can be compressed before they are placed in a leaf. The codec is
+// recorded in the top bits of the value length, so compressed and plain
+// values coexist, and the values of older files are plain.
+// | klen | codec | vlen | key | val |
+// |  2B  |  4b   | 12b  |     |     |
+// A value is only compressed if it gets smaller, so the stored size is
+// still limited by BTREE_MAX_VAL_SIZE.
+
+type Codec uint8
+
+const (
+	CODEC_NONE  Codec = 0
+	CODEC_FLATE Codec = 1 // DEFLATE, compress/flate
+)
+
+const VAL_LEN_BITS = 12
+const VAL_LEN_MASK = 1<<VAL_LEN_BITS - 1
+const COMPRESS_MIN = 64 // the default smallest value to compress
+
+var ErrCodec = errors.New("bad compressed value")
+
+func init() {
+	assert(BTREE_MAX_VAL_SIZE <= VAL_LEN_MASK, "value length bits")
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CODEC_NONE:
+		return "none"
+	case CODEC_FLATE:
+		return "flate"
+	}
+	return fmt.Sprintf("codec%d", uint8(c))
+}
+
+// reused, since a flate state is large
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+var flateReaders = sync.Pool{New: func() any {
+	return flate.NewReader(nil)
+}}
+
+func compressVal(codec Codec, val []byte) []byte {
+	assert(codec == CODEC_FLATE, "unknown codec")
+	b := &bytes.Buffer{}
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(b)
+	_, _ = w.Write(val) // a bytes.Buffer doesn't fail
+	_ = w.Close()
+	flateWriters.Put(w)
+	return b.Bytes()
+}
+
+// the BTree callbacks can't return errors, so a bad value is a panic,
+// like a read error.
+func decodeVal(codec Codec, stored []byte) []byte {
+	if codec == CODEC_NONE {
+		return stored
+	}
+	if codec != CODEC_FLATE {
+		panic(fmt.Errorf("%w: unknown codec %d", ErrCodec, codec))
+	}
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	_ = r.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+	val, err := io.ReadAll(io.LimitReader(r, BTREE_MAX_VAL_SIZE+1))
+	if err == nil && len(val) > BTREE_MAX_VAL_SIZE {
+		err = errors.New("value too big")
+	}
+	if err != nil {
+		panic(fmt.Errorf("%w: %w", ErrCodec, err))
+	}
+	return val
+}
+
+// the value to place in a leaf and its codec
+func (tree *BTree) encodeVal(val []byte) ([]byte, Codec) {
+	if tree.codec == CODEC_NONE || len(val) < tree.compressMin {
+		return val, CODEC_NONE
+	}
+	stored := compressVal(tree.codec, val)
+	if len(stored) >= len(val) {
+		return val, CODEC_NONE // incompressible
+	}
+	if m := tree.metrics; m != nil {
+		m.compressed.Add(1)
+		m.compressIn.Add(uint64(len(val)))
+		m.compressOut.Add(uint64(len(stored)))
+	}
+	return stored, tree.codec
+}
@@ -0,0 +1,162 @@
+package btree
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustGetKV(t *testing.T, db *KV, key string, want []byte) {
+	t.Helper()
+	got, ok := db.Get([]byte(key))
+	if !ok || !bytes.Equal(got, want) {
+		t.Fatalf("%q: got %d bytes %v, want %d", key, len(got), ok, len(want))
+	}
+}
+
+func compressedVals(t *testing.T, db *KV) (tree int, buckets map[string]BucketShape) {
+	t.Helper()
+	stats, err := db.TreeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets = map[string]BucketShape{}
+	for _, b := range stats.Buckets {
+		buckets[strings.Join(b.Path, "/")] = b
+	}
+	return stats.Tree.Compressed, buckets
+}
+
+func TestCompressValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	const min = 200 // flate stores the shorter values raw anyway
+	db := openKV(t, &KV{Path: path, Compress: CODEC_FLATE, CompressMin: min})
+	random := make([]byte, 500)
+	rand.New(rand.NewSource(1)).Read(random)
+	vals := map[string][]byte{
+		"at the min":    bytes.Repeat([]byte("a"), min),
+		"below the min": bytes.Repeat([]byte("a"), min-1),
+		"random":        random, // stored raw
+		"large":         []byte(strings.Repeat("compressible ", BTREE_MAX_VAL_SIZE/13)),
+	}
+	for key, val := range vals {
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := compressedVals(t, db); n != 2 {
+		t.Fatalf("%d compressed values", n)
+	}
+	for key, val := range vals {
+		mustGetKV(t, db, key, val)
+	}
+	// only the raw values take their full size
+	stats, _ := db.TreeStats()
+	raw := uint64(min - 1 + len(random))
+	if stats.Tree.StoredBytes <= raw || stats.Tree.StoredBytes >= raw+100 {
+		t.Fatalf("%d bytes stored", stats.Tree.StoredBytes)
+	}
+	// the default min
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openKV(t, &KV{Path: path, Compress: CODEC_FLATE})
+	if err := db.Set([]byte("default"), vals["below the min"]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := compressedVals(t, db); n != 3 {
+		t.Fatalf("%d compressed values", n)
+	}
+	mustGetKV(t, db, "default", vals["below the min"])
+}
+
+func TestCompressReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path, Compress: CODEC_FLATE})
+	old := []byte(strings.Repeat("old value ", 50))
+	setKeys(t, db, 200, string(old))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the compressed values are read without the setting, new ones are plain
+	db = openKV(t, &KV{Path: path})
+	new := []byte(strings.Repeat("new value ", 50))
+	tx := db.Begin()
+	for i := 0; i < 100; i++ {
+		if err := tx.Set([]byte(testKey(i)), new); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := compressedVals(t, db); n != 200 {
+		t.Fatalf("%d compressed values", n)
+	}
+	mustGetKV(t, db, "key0000", old)
+	mustGetKV(t, db, testKey(0), new)
+	// replacing an old value stores it plain
+	if err := db.Set([]byte("key0001"), new); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := compressedVals(t, db); n != 199 {
+		t.Fatalf("%d compressed values", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// and compressed again
+	db = openKV(t, &KV{Path: path, Compress: CODEC_FLATE})
+	if err := db.Set([]byte("key0001"), old); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := compressedVals(t, db); n != 200 {
+		t.Fatalf("%d compressed values", n)
+	}
+	mustGetKV(t, db, "key0001", old)
+	mustGetKV(t, db, testKey(1), new)
+	if err := db.tree.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressInlineBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path, Compress: CODEC_FLATE})
+	b, err := db.CreateBucket("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each value alone is more than BUCKET_INLINE_MAX bytes uncompressed
+	val := []byte(strings.Repeat("x", BUCKET_INLINE_MAX+10))
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := b.Set([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, buckets := compressedVals(t, db)
+	if shape := buckets["b"]; !shape.Inline || shape.Compressed != 3 {
+		t.Fatalf("bucket %+v", shape)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// read without the setting, a new plain value moves it to a page
+	db = openKV(t, &KV{Path: path})
+	if b, err = db.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, b, "k2", string(val))
+	if err := b.Set([]byte("k4"), val); err != nil {
+		t.Fatal(err)
+	}
+	_, buckets = compressedVals(t, db)
+	if shape := buckets["b"]; shape.Inline || shape.Compressed != 3 || shape.Keys.N != 4 {
+		t.Fatalf("bucket %+v", shape)
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		mustGet(t, b, key, string(val))
+	}
+}
@@ -0,0 +1,199 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"testing"
+)
+
+// a randomized workload of small transactions. it returns the data of each
+// committed transaction, and of the failed one that may still be persisted.
+func crashWorkload(db *KV, seed int64, ntx int) (committed []map[string]string, failed []map[string]string) {
+	rng := rand.New(rand.NewSource(seed))
+	ref := map[string]string{}
+	committed = append(committed, maps.Clone(ref))
+	for i := 0; i < ntx; i++ {
+		next := maps.Clone(committed[len(committed)-1])
+		tx := db.Begin()
+		for j := rng.Intn(8) + 1; j > 0; j-- {
+			key := fmt.Sprintf("key%03d", rng.Intn(200))
+			if rng.Intn(4) == 0 {
+				if _, err := tx.Del([]byte(key)); err != nil {
+					panic(err)
+				}
+				delete(next, key)
+				continue
+			}
+			val := fmt.Sprintf("%d-%d", i, j)
+			for k := rng.Intn(400); k > 0; k-- {
+				val += "x" // large values for splits
+			}
+			if err := tx.Set([]byte(key), []byte(val)); err != nil {
+				panic(err)
+			}
+			next[key] = val
+		}
+		if err := db.Commit(tx); err != nil {
+			failed = append(failed, next)
+			continue
+		}
+		committed = append(committed, next)
+		failed = nil // replaced by a later commit
+	}
+	return committed, failed
+}
+
+func dumpKV(db *KV) map[string]string {
+	tx := db.Begin()
+	defer db.Abort(tx)
+	data := map[string]string{}
+	for iter := tx.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) > 0 {
+			data[string(key)] = string(val)
+		}
+	}
+	return data
+}
+
+// reopen the crashed disk and verify it holds one of the possible versions
+func verifyRecovery(t *testing.T, store *FaultStore, possible []map[string]string) {
+	t.Helper()
+	db := &KV{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if err := db.Check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	got := dumpKV(db)
+	ok := false
+	for _, data := range possible {
+		ok = ok || maps.Equal(got, data)
+	}
+	if !ok {
+		t.Fatalf("recovered %d keys, not a committed version", len(got))
+	}
+	// the recovered DB is still writable
+	if _, failed := crashWorkload(db, 1, 5); len(failed) > 0 {
+		t.Fatal("write after recovery")
+	}
+	if err := db.Check(); err != nil {
+		t.Fatalf("check after recovery: %v", err)
+	}
+}
+
+func TestCrashAtEveryStep(t *testing.T) {
+	const NTX = 30
+	// count the steps of a full run
+	store := NewFaultStore(0)
+	db := &KV{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	crashWorkload(db, 0, NTX)
+	nops := store.Ops()
+
+	for at := 1; at <= nops; at++ {
+		for seed := int64(0); seed < 4; seed++ {
+			t.Run(fmt.Sprintf("op%d/seed%d", at, seed), func(t *testing.T) {
+				store := NewFaultStore(seed)
+				store.CrashAt = at
+				db := &KV{Store: store}
+				if err := db.Open(); err != nil {
+					t.Fatal(err)
+				}
+				committed, failed := crashWorkload(db, 0, NTX)
+				// the last commit is durable, the interrupted one may be
+				possible := append(committed[len(committed)-1:], failed...)
+				verifyRecovery(t, store.Crash(), possible)
+			})
+		}
+	}
+}
+
+func TestFailedSync(t *testing.T) {
+	const NTX = 30
+	for at := 1; at <= 2*NTX; at++ {
+		for seed := int64(0); seed < 4; seed++ {
+			t.Run(fmt.Sprintf("sync%d/seed%d", at, seed), func(t *testing.T) {
+				store := NewFaultStore(seed)
+				store.FailSyncAt = at
+				db := &KV{Store: store}
+				if err := db.Open(); err != nil {
+					t.Fatal(err)
+				}
+				committed, failed := crashWorkload(db, 0, NTX)
+				last := committed[len(committed)-1]
+				// a failed commit is reverted in memory
+				if !maps.Equal(dumpKV(db), last) {
+					t.Fatal("in-memory data is not the last commit")
+				}
+				verifyRecovery(t, store.Crash(), append([]map[string]string{last}, failed...))
+			})
+		}
+	}
+}
+
+// a crash right after a commit loses nothing
+func TestCrashAfterCommit(t *testing.T) {
+	store := NewFaultStore(0)
+	db := &KV{Store: store}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		crashWorkload(db, int64(i), 1)
+		want := dumpKV(db)
+		store = store.Crash()
+		db = &KV{Store: store}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if got := dumpKV(db); !maps.Equal(got, want) {
+			t.Fatalf("commit %d lost", i)
+		}
+	}
+}
+
+func TestFaultStoreTear(t *testing.T) {
+	store := NewFaultStore(0)
+	old := make([]byte, BTREE_PAGE_SIZE)
+	if err := store.WritePages(map[uint64][]byte{0: old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		page := make([]byte, BTREE_PAGE_SIZE)
+		for j := range page {
+			page[j] = 1
+		}
+		if err := store.WritePages(map[uint64][]byte{0: page}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Crash().ReadPage(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every sector is either old or new
+		for off := 0; off < BTREE_PAGE_SIZE; off += FAULT_SECTOR {
+			for _, b := range got[off+1 : off+FAULT_SECTOR] {
+				if b != got[off] {
+					t.Fatalf("sector %d is torn", off/FAULT_SECTOR)
+				}
+			}
+		}
+	}
+	store.CrashAt = store.Ops() + 1
+	if err := store.Sync(); !errors.Is(err, ErrInjected) {
+		t.Fatalf("crash: %v", err)
+	}
+	if err := store.WritePages(map[uint64][]byte{1: old}); !errors.Is(err, ErrInjected) {
+		t.Fatalf("write after crash: %v", err)
+	}
+}
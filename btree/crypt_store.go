@@ -0,0 +1,241 @@
+package btree
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Pages are encrypted with AES-GCM. The node is encrypted in place and the
+// tag and the random nonce go to the reserved trailer:
+// | ciphertext | tag | nonce |
+// |   4068B    | 16B |  12B  |
+// The page pointer is authenticated, so pages can't be swapped.
+//
+// The meta page holds no user data. It stays readable and is only
+// authenticated, with the id of the key, so that a wrong key is detected
+// before any page is decrypted. Its tag and nonce follow the meta data in
+// the 1st sector, which is written atomically.
+// | meta | tag | nonce |
+// | 120B | 16B |  12B  |
+const (
+	PAGE_TAG_SIZE   = 16
+	PAGE_NONCE_SIZE = 12
+	META_KEY_ID     = 104 // the offset of the key id in the meta page
+)
+
+var (
+	ErrEncrypted    = errors.New("encrypted, a key is required")
+	ErrNotEncrypted = errors.New("not encrypted, rotate to a key first")
+	ErrWrongKey     = errors.New("wrong key")
+	ErrPageAuth     = errors.New("page authentication failed")
+	ErrPageTooLarge = errors.New("node too large for the page trailer")
+	ErrRotating     = errors.New("a key rotation is running or was interrupted")
+)
+
+// identifies a key without revealing it, 0 is for no key
+func KeyID(key []byte) uint64 {
+	sum := sha256.Sum256(append([]byte("dbfs page key\x00"), key...))
+	return binary.LittleEndian.Uint64(sum[:8]) | 1
+}
+
+// a page store that encrypts the pages of another store. pages are
+// decrypted on every read, the inner store caches the encrypted ones.
+type cryptStore struct {
+	PageStore // the encrypted pages
+	aead      cipher.AEAD
+	keyID     uint64
+}
+
+func newCryptStore(store PageStore, key []byte) (*cryptStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("page key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("page key: %w", err)
+	}
+	assert(aead.NonceSize()+aead.Overhead() == PAGE_TRAILER, "page trailer size")
+	return &cryptStore{PageStore: store, aead: aead, keyID: KeyID(key)}, nil
+}
+
+// the store under the encryption, if any
+func baseStore(store PageStore) PageStore {
+	if s, ok := store.(*cryptStore); ok {
+		return s.PageStore
+	}
+	return store
+}
+
+func pageAAD(ptr uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, ptr)
+}
+
+// the bytes used by a node, which must leave room for the trailer
+func pageUsed(page []byte) int {
+	node := BNode(page)
+	switch node.btype() {
+	case BNODE_NODE, BNODE_LEAF:
+		return int(node.nbytes())
+	case BNODE_FREE_RUNS:
+		return FREE_LIST_HEADER + 12*flnSize(node)
+	case BNODE_FREE_LIST:
+		return FREE_LIST_HEADER + 8*flnSize(node)
+	}
+	return len(page)
+}
+
+func (s *cryptStore) ReadPage(ptr uint64) (BNode, error) {
+	page, err := s.PageStore.ReadPage(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if ptr == 0 {
+		return s.readMeta(page)
+	}
+	out := make([]byte, BTREE_PAGE_SIZE)
+	nonce := page[BTREE_NODE_MAX+PAGE_TAG_SIZE:]
+	_, err = s.aead.Open(out[:0], nonce, page[:BTREE_NODE_MAX+PAGE_TAG_SIZE], pageAAD(ptr))
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", ptr, ErrPageAuth)
+	}
+	return out, nil
+}
+
+func (s *cryptStore) readMeta(page []byte) (BNode, error) {
+	if bytes.Equal(page[:16], make([]byte, 16)) {
+		return page, nil // a new DB
+	}
+	switch id := binary.LittleEndian.Uint64(page[META_KEY_ID:]); {
+	case id == 0:
+		return nil, ErrNotEncrypted
+	case id != s.keyID:
+		return nil, ErrWrongKey
+	}
+	tag := page[META_SIZE : META_SIZE+PAGE_TAG_SIZE]
+	nonce := page[META_SIZE+PAGE_TAG_SIZE : META_SIZE+PAGE_TRAILER]
+	if _, err := s.aead.Open(nil, nonce, tag, page[:META_SIZE]); err != nil {
+		return nil, fmt.Errorf("meta page: %w", ErrPageAuth)
+	}
+	return page, nil
+}
+
+func (s *cryptStore) WritePages(pages map[uint64][]byte) error {
+	out := make(map[uint64][]byte, len(pages))
+	for ptr, page := range pages {
+		enc := make([]byte, BTREE_PAGE_SIZE)
+		var nonce [PAGE_NONCE_SIZE]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return fmt.Errorf("page nonce: %w", err)
+		}
+		if ptr == 0 {
+			// stamp the key id and authenticate the meta page
+			copy(enc[:META_SIZE], page)
+			binary.LittleEndian.PutUint64(enc[META_KEY_ID:], s.keyID)
+			tag := s.aead.Seal(nil, nonce[:], nil, enc[:META_SIZE])
+			copy(enc[META_SIZE:], tag)
+			copy(enc[META_SIZE+PAGE_TAG_SIZE:], nonce[:])
+			out[ptr] = enc
+			continue
+		}
+		if pageUsed(page) > BTREE_NODE_MAX {
+			return fmt.Errorf("page %d: %w", ptr, ErrPageTooLarge)
+		}
+		s.aead.Seal(enc[:0], nonce[:], page[:BTREE_NODE_MAX], pageAAD(ptr))
+		copy(enc[BTREE_NODE_MAX+PAGE_TAG_SIZE:], nonce[:])
+		out[ptr] = enc
+	}
+	return s.PageStore.WritePages(out)
+}
+
+// Re-encrypt a DB file with a new key, or decrypt it if `newKey` is nil.
+// `oldKey` is nil for a file that is not encrypted. The DB must not be open.
+//
+// All reachable pages are copied to a new file, like a restore from a
+// backup, which then replaces the old file, so a crash leaves either of
+// them intact. Note that backups hold the decrypted pages.
+func RotateKey(file string, oldKey []byte, newKey []byte) error {
+	// the new file is created first, so that a concurrent rotation fails
+	tmp := file + ".rotate"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("rotate key: %w: remove %s if no rotation is running", ErrRotating, tmp)
+	}
+	if err != nil {
+		return fmt.Errorf("rotate key: %w", err)
+	}
+	err = fp.Close()
+	if err == nil {
+		err = rotateFile(file, tmp, oldKey, newKey)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err == nil {
+		err = syncDir(path.Dir(file))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rotate key: %w", err)
+	}
+	return nil
+}
+
+// copy the DB at `file` into the empty file `tmp`
+func rotateFile(file string, tmp string, oldKey []byte, newKey []byte) error {
+	db := &KV{Path: file, Key: oldKey}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	err := rotateTo(db, tmp, newKey)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func rotateTo(db *KV, file string, key []byte) error {
+	store, err := OpenFileStore(file, IO_PREAD, WRITE_BUFFERED, 0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if key != nil {
+		if store, err = newCryptStore(store, key); err != nil {
+			return err
+		}
+	}
+	// stream a backup of the old file into the new one
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		w.CloseWithError(db.Backup(w))
+		close(done)
+	}()
+	head, meta, err := applyBackup(storeWriter{store}, r)
+	r.CloseWithError(err) // stops the backup on errors
+	<-done
+	if err != nil {
+		return err
+	}
+	// the data pages are durable before the meta page makes them visible
+	if err = store.Truncate(head.npages); err == nil {
+		err = store.Sync()
+	}
+	if err == nil {
+		err = writeMeta(store, meta)
+	}
+	if err == nil {
+		err = store.Sync()
+	}
+	return err
+}
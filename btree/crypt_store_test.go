@@ -0,0 +1,168 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPage(val string) []byte {
+	page := BNode(make([]byte, BTREE_PAGE_SIZE))
+	page.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(page, 0, 0, nil, nil)
+	nodeAppendKV(page, 1, 0, []byte("key"), []byte(val))
+	return page
+}
+
+func TestCryptStorePages(t *testing.T) {
+	inner := NewMemStore()
+	key := bytes.Repeat([]byte{1}, 32)
+	store, err := newCryptStore(inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := map[uint64][]byte{1: testPage("secret one"), 2: testPage("secret two")}
+	if err := store.WritePages(pages); err != nil {
+		t.Fatal(err)
+	}
+	for ptr, want := range pages {
+		got, err := store.ReadPage(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:BTREE_NODE_MAX], want[:BTREE_NODE_MAX]) {
+			t.Fatalf("page %d differs", ptr)
+		}
+		enc, _ := inner.ReadPage(ptr)
+		if bytes.Contains(enc, []byte("secret")) {
+			t.Fatalf("page %d is not encrypted", ptr)
+		}
+	}
+	// another key can't read the pages
+	other, _ := newCryptStore(inner, bytes.Repeat([]byte{2}, 32))
+	if _, err := other.ReadPage(1); !errors.Is(err, ErrPageAuth) {
+		t.Fatalf("another key: %v", err)
+	}
+	// a flipped byte
+	enc, _ := inner.ReadPage(1)
+	bad := bytes.Clone(enc)
+	bad[100] ^= 1
+	if err := inner.WritePages(map[uint64][]byte{1: bad}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadPage(1); !errors.Is(err, ErrPageAuth) {
+		t.Fatalf("flipped byte: %v", err)
+	}
+	// a valid page moved to another pointer
+	if err := inner.WritePages(map[uint64][]byte{2: enc}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadPage(2); !errors.Is(err, ErrPageAuth) {
+		t.Fatalf("swapped page: %v", err)
+	}
+	// a node that overlaps the trailer
+	big := testPage(strings.Repeat("v", BTREE_NODE_MAX-20))
+	if err := store.WritePages(map[uint64][]byte{3: big}); !errors.Is(err, ErrPageTooLarge) {
+		t.Fatalf("large page: %v", err)
+	}
+}
+
+// open a DB file, which is expected to fail with `want`
+func openErr(t *testing.T, path string, key []byte, want error) {
+	t.Helper()
+	db := &KV{Path: path, Key: key}
+	err := db.Open()
+	if err == nil {
+		db.Close()
+	}
+	if !errors.Is(err, want) {
+		t.Fatalf("open: %v, want %v", err, want)
+	}
+}
+
+func checkKeys(t *testing.T, path string, key []byte, n int, val string) {
+	t.Helper()
+	db := openKV(t, &KV{Path: path, Key: key})
+	for i := 0; i < n; i++ {
+		got, ok := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if !ok || string(got) != val {
+			t.Fatalf("key %d: %q %v", i, got, ok)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	db := openKV(t, &KV{Path: path, Key: key1})
+	setKeys(t, db, 1000, "encrypted value")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("encrypted value")) {
+		t.Fatal("plain text in the file")
+	}
+	checkKeys(t, path, key1, 1000, "encrypted value")
+	openErr(t, path, key2, ErrWrongKey)
+	openErr(t, path, nil, ErrEncrypted)
+	// a new key
+	if err := RotateKey(path, key1, key2); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, path, key2, 1000, "encrypted value")
+	openErr(t, path, key1, ErrWrongKey)
+	if err := RotateKey(path, key1, key2); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("rotate with the old key: %v", err)
+	}
+	// decrypt, then a plain file can't be opened with a key
+	if err := RotateKey(path, key2, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, path, nil, 1000, "encrypted value")
+	openErr(t, path, key1, ErrNotEncrypted)
+	if _, err := os.Stat(path + ".rotate"); !os.IsNotExist(err) {
+		t.Fatalf("temp file: %v", err)
+	}
+}
+
+func TestRotateKeyStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	key := bytes.Repeat([]byte{1}, 32)
+	db := openKV(t, &KV{Path: path})
+	setKeys(t, db, 100, "val")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// left by an interrupted rotation, or owned by a running one
+	if err := os.WriteFile(path+".rotate", []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := RotateKey(path, nil, key)
+	if !errors.Is(err, ErrRotating) || !strings.Contains(err.Error(), path+".rotate") {
+		t.Fatalf("stale temp file: %v", err)
+	}
+	if data, err := os.ReadFile(path + ".rotate"); err != nil || string(data) != "partial" {
+		t.Fatalf("the temp file is changed: %q %v", data, err)
+	}
+	checkKeys(t, path, nil, 100, "val")
+	// rotates once it's removed
+	if err := os.Remove(path + ".rotate"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RotateKey(path, nil, key); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, path, key, 100, "val")
+}
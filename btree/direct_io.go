@@ -0,0 +1,267 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Writes through O_DIRECT bypass the page cache, so the pages are copied to
+// aligned buffers. The pages of a commit are grouped into runs of
+// contiguous pages, each written by a vectored write, which are submitted
+// together through io_uring, or one by one with pwritev without it.
+
+const (
+	DIRECT_ALIGN    = 4096 // the buffer alignment for O_DIRECT
+	IOV_MAX         = 1024 // iovecs per vectored write
+	URING_ENTRIES   = 64
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+)
+
+// for benchmarks and tests: always use pwritev
+var disableURing = false
+
+type directWriter struct {
+	fd   int    // opened with O_DIRECT
+	ring *uring // nil if io_uring is not available
+	buf  []byte // aligned, for the pages of a commit
+}
+
+func openDirectWriter(file string) (*directWriter, error) {
+	fd, err := syscall.Open(file, os.O_RDWR|syscall.O_DIRECT|syscall.O_CLOEXEC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open direct: %w", err)
+	}
+	w := &directWriter{fd: fd}
+	if !disableURing {
+		w.ring, _ = newURing(URING_ENTRIES) // fall back to pwritev
+	}
+	return w, nil
+}
+
+func (w *directWriter) usingURing() bool {
+	return w.ring != nil
+}
+
+// an aligned buffer of at least `size` bytes
+func (w *directWriter) buffer(size int) []byte {
+	if len(w.buf) < size {
+		raw := make([]byte, size+DIRECT_ALIGN)
+		off := int(-uintptr(unsafe.Pointer(&raw[0])) & (DIRECT_ALIGN - 1))
+		w.buf = raw[off : off+size]
+	}
+	return w.buf[:size]
+}
+
+// a vectored write of contiguous pages
+type directRun struct {
+	offset int64
+	iovs   []syscall.Iovec
+}
+
+func (w *directWriter) writePages(pages map[uint64][]byte) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	buf := w.buffer(len(pages) * BTREE_PAGE_SIZE)
+	runs := []directRun{}
+	prev := uint64(0)
+	for i, ptr := range slices.Sorted(maps.Keys(pages)) {
+		page := buf[i*BTREE_PAGE_SIZE : (i+1)*BTREE_PAGE_SIZE]
+		copy(page, pages[ptr])
+		last := len(runs) - 1
+		if last < 0 || ptr != prev+1 || len(runs[last].iovs) == IOV_MAX {
+			runs = append(runs, directRun{offset: int64(ptr * BTREE_PAGE_SIZE)})
+			last++
+		}
+		iov := syscall.Iovec{Base: &page[0]}
+		iov.SetLen(BTREE_PAGE_SIZE)
+		runs[last].iovs = append(runs[last].iovs, iov)
+		prev = ptr
+	}
+	var err error
+	if w.ring != nil {
+		err = w.ring.writev(w.fd, runs)
+	} else {
+		err = pwritev(w.fd, runs)
+	}
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return fmt.Errorf("write page: %w", err)
+	}
+	return nil
+}
+
+func pwritev(fd int, runs []directRun) error {
+	for _, run := range runs {
+		want := len(run.iovs) * BTREE_PAGE_SIZE
+		n, _, errno := syscall.Syscall6(syscall.SYS_PWRITEV, uintptr(fd),
+			uintptr(unsafe.Pointer(&run.iovs[0])), uintptr(len(run.iovs)),
+			uintptr(run.offset), 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		if int(n) != want {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+func (w *directWriter) close() error {
+	if w.ring != nil {
+		w.ring.close()
+	}
+	return syscall.Close(w.fd)
+}
+
+// a minimal io_uring for batched writes
+type uring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+	params uringParams
+}
+
+// struct io_uring_params
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+const (
+	IORING_OFF_SQ_RING     = 0
+	IORING_OFF_CQ_RING     = 0x8000000
+	IORING_OFF_SQES        = 0x10000000
+	IORING_OP_WRITEV       = 2
+	IORING_ENTER_GETEVENTS = 1
+	URING_SQE_SIZE         = 64
+	URING_CQE_SIZE         = 16
+)
+
+var errURing = errors.New("io_uring")
+
+func newURing(entries uint32) (*uring, error) {
+	r := &uring{}
+	fd, _, errno := syscall.Syscall(sysIOURingSetup, uintptr(entries),
+		uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w setup: %w", errURing, errno)
+	}
+	r.fd = int(fd)
+	p := &r.params
+	mmap := func(offset int64, size int) ([]byte, error) {
+		return syscall.Mmap(r.fd, offset, size,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	}
+	var err error
+	r.sqRing, err = mmap(IORING_OFF_SQ_RING, int(p.sqOff.array+p.sqEntries*4))
+	if err == nil {
+		r.cqRing, err = mmap(IORING_OFF_CQ_RING, int(p.cqOff.cqes+p.cqEntries*URING_CQE_SIZE))
+	}
+	if err == nil {
+		r.sqes, err = mmap(IORING_OFF_SQES, int(p.sqEntries*URING_SQE_SIZE))
+	}
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("%w mmap: %w", errURing, err)
+	}
+	return r, nil
+}
+
+func ringU32(ring []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[off]))
+}
+
+// submit the writes and wait for them, in batches of the ring size
+func (r *uring) writev(fd int, runs []directRun) error {
+	p := &r.params
+	for len(runs) > 0 {
+		n := min(len(runs), int(p.sqEntries))
+		tail := atomic.LoadUint32(ringU32(r.sqRing, p.sqOff.tail))
+		mask := *ringU32(r.sqRing, p.sqOff.ringMask)
+		for i, run := range runs[:n] {
+			idx := (tail + uint32(i)) & mask
+			sqe := r.sqes[idx*URING_SQE_SIZE : (idx+1)*URING_SQE_SIZE]
+			clear(sqe)
+			sqe[0] = IORING_OP_WRITEV
+			*(*int32)(unsafe.Pointer(&sqe[4])) = int32(fd)
+			*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(run.offset)
+			*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&run.iovs[0])))
+			*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(run.iovs))
+			*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(i) // user data
+			*ringU32(r.sqRing, p.sqOff.array+4*idx) = idx
+		}
+		atomic.StoreUint32(ringU32(r.sqRing, p.sqOff.tail), tail+uint32(n))
+		err := r.enter(n, runs[:n])
+		runtime.KeepAlive(runs)
+		if err != nil {
+			return err
+		}
+		runs = runs[n:]
+	}
+	return nil
+}
+
+// submit `n` entries and reap their completions
+func (r *uring) enter(n int, runs []directRun) error {
+	p := &r.params
+	submit := n
+	var err error
+	for done := 0; done < n; {
+		ret, _, errno := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(submit),
+			uintptr(n-done), IORING_ENTER_GETEVENTS, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			// the ring state is unknown, which is not recoverable
+			return fmt.Errorf("%w enter: %w", errURing, errno)
+		}
+		submit -= int(ret) // the number submitted
+		head := atomic.LoadUint32(ringU32(r.cqRing, p.cqOff.head))
+		tail := atomic.LoadUint32(ringU32(r.cqRing, p.cqOff.tail))
+		mask := *ringU32(r.cqRing, p.cqOff.ringMask)
+		for ; head != tail; head++ {
+			off := p.cqOff.cqes + (head&mask)*URING_CQE_SIZE
+			cqe := r.cqRing[off : off+URING_CQE_SIZE]
+			i := *(*uint64)(unsafe.Pointer(&cqe[0]))
+			res := *(*int32)(unsafe.Pointer(&cqe[8]))
+			switch {
+			case res < 0 && err == nil:
+				err = syscall.Errno(-res)
+			case res >= 0 && int(res) != len(runs[i].iovs)*BTREE_PAGE_SIZE && err == nil:
+				err = io.ErrShortWrite
+			}
+			done++
+		}
+		atomic.StoreUint32(ringU32(r.cqRing, p.cqOff.head), head)
+	}
+	return err
+}
+
+func (r *uring) close() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if m != nil {
+			_ = syscall.Munmap(m)
+		}
+	}
+	_ = syscall.Close(r.fd)
+}
@@ -0,0 +1,103 @@
+package btree
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// the write backends, with and without io_uring
+var writeBackends = []struct {
+	name    string
+	write   WriteMode
+	noURing bool
+}{
+	{"buffered", WRITE_BUFFERED, false},
+	{"direct", WRITE_DIRECT, false},
+	{"direct-pwritev", WRITE_DIRECT, true},
+}
+
+func openWithBackend(tb testing.TB, path string, io IOMode, write WriteMode, noURing bool) *KV {
+	old := disableURing
+	disableURing = noURing
+	defer func() { disableURing = old }()
+	db := &KV{Path: path, IO: io, Write: write}
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// commit random sets, which touch scattered pages
+func commitBatch(tb testing.TB, db *KV, rng *rand.Rand, nkeys int, ref map[string]string) {
+	tx := db.Begin()
+	for i := 0; i < nkeys; i++ {
+		key := fmt.Sprintf("key%08d", rng.Intn(100000))
+		val := fmt.Sprintf("%0*d", 100+rng.Intn(200), rng.Int())
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			tb.Fatal(err)
+		}
+		if ref != nil {
+			ref[key] = val
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestDirectWrite(t *testing.T) {
+	for _, backend := range writeBackends[1:] {
+		for name, io := range map[string]IOMode{"mmap": IO_MMAP, "pread": IO_PREAD} {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "db")
+				db := openWithBackend(t, path, io, backend.write, backend.noURing)
+				if w, ok := db.store.(*mmapStore); ok {
+					t.Logf("io_uring: %v", w.w.(*directWriter).usingURing())
+				}
+				rng := rand.New(rand.NewSource(1))
+				ref := map[string]string{}
+				for i := 0; i < 50; i++ {
+					commitBatch(t, db, rng, 100, ref)
+				}
+				if got := dumpKV(db); !maps.Equal(got, ref) {
+					t.Fatal("data mismatch before reopening")
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+				// read back through the page cache
+				db = openWithBackend(t, path, io, WRITE_BUFFERED, false)
+				defer db.Close()
+				if err := db.Check(); err != nil {
+					t.Fatal(err)
+				}
+				if got := dumpKV(db); !maps.Equal(got, ref) {
+					t.Fatal("data mismatch after reopening")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCommit(b *testing.B) {
+	for _, batch := range []int{1, 100, 1000} {
+		for _, backend := range writeBackends {
+			b.Run(fmt.Sprintf("%s/keys=%d", backend.name, batch), func(b *testing.B) {
+				path := filepath.Join(b.TempDir(), "db")
+				db := openWithBackend(b, path, IO_MMAP, backend.write, backend.noURing)
+				defer db.Close()
+				rng := rand.New(rand.NewSource(1))
+				for i := 0; i < 20; i++ {
+					commitBatch(b, db, rng, 1000, nil) // a tree of a few levels
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					commitBatch(b, db, rng, batch, nil)
+				}
+			})
+		}
+	}
+}
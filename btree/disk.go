@@ -1,77 +1,130 @@
 package btree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sync"
 	"syscall"
 )
 
 type KV struct {
-	Path   string
-	fd     int
+	Path        string
+	Comparator  *Comparator // key order of the default tree, must match an existing DB
+	IO          IOMode      // how to read a file, mmap by default
+	Write       WriteMode   // how to write a file, through the page cache by default
+	CacheSize   int         // the buffer pool size in bytes for IO_PREAD
+	Key         []byte      // an AES key to encrypt the pages, see RotateKey
+	Compress    Codec       // compress the values of the tree and the buckets
+	CompressMin int         // the smallest value to compress, COMPRESS_MIN by default
+	Nodes       NodePolicy  // node splits and merges of all trees
+	Store       PageStore   // instead of the file at `Path` if not nil, closed by Close
+	store       PageStore
 	tree   BTree
 	failed bool // Did the last update fail?
 	free   FreeList
+	held   FreeList // freed pages that a snapshot may still read
+	seq    uint64     // sequence number of the last commit with changes
+	gen    uint64     // generation of the last commit, stamped on written pages
+	mu     sync.Mutex // held by the active transaction
+	pinned map[uint64]int // gen => number of live snapshots
+	unpin  sync.Cond      // signaled when a snapshot is released
+	// replication
+	readonly bool                      // a replica only applies pages from its primary
+	replicas map[*replicaConn]struct{} // connected replicas of a primary
 
-	mmap struct {
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
 	page struct {
 		flushed uint64            // database size in number of pages
-		temp    [][]byte          // newly allocated pages
 		nfree int //number of pages taken from free list
 		nappend uint64            // number of pages to be appended
 		updates map[uint64][]byte // pending updates, including appended pages
+		recycle []uint64          // pages allocated and freed by the current transaction
 	}
+	cdc     changeLog
+	catalog BTree // bucket name => root and comparator
+	metrics metrics
 }
+
 // callback for BTree & FreeList, dereference a pointer.
 func (db *KV) pageGet(ptr uint64) BNode {
 	if page, ok := db.page.updates[ptr]; ok {
-	assert(page != nil, " page nil")
-	return BNode(page) // for new pages
+		assert(page != nil, " page nil")
+		return BNode(page) // for new pages
 	}
 	return pageGetMapped(db, ptr) // for written pages
-	}
+}
 
+// a written page. the BTree callbacks can't return errors,
+// so a read error is a panic, which can be recovered unlike a SIGBUS.
 func pageGetMapped(db *KV, ptr uint64) BNode {
-		start := uint64(0)
-		for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode(chunk[offset : offset+BTREE_PAGE_SIZE])
-			}
-			start = end
-			}
-			panic("bad ptr")
-			}
+	return readPage(db.store, ptr)
+}
+
+func readPage(store PageStore, ptr uint64) BNode {
+	page, err := store.ReadPage(ptr)
+	if err != nil {
+		panic(err)
+	}
+	return page
+}
+
 // callback for BTree, allocate a new page.
 func (db *KV) pageNew(node BNode) uint64 {
 	assert(len(node) <= BTREE_PAGE_SIZE, "node size too big")
 	ptr := uint64(0)
-	if db.page.nfree < db.free.Total() {
-	// reuse a deallocated page
-	ptr = db.free.Get(db.page.nfree)
-	db.page.nfree++
+	if n := len(db.page.recycle); n > 0 {
+		// reuse a page that was never written
+		ptr, db.page.recycle = db.page.recycle[n-1], db.page.recycle[:n-1]
+		db.metrics.recycled.Add(1)
+	} else if db.page.nfree < db.free.Total() {
+		// reuse a deallocated page
+		ptr = db.free.Get(db.page.nfree)
+		db.page.nfree++
+		db.metrics.reused.Add(1)
 	} else {
-	// append a new page
-	ptr = db.page.flushed + uint64(db.page.nappend)
-	db.page.nappend++
+		// append a new page
+		ptr = db.page.flushed + uint64(db.page.nappend)
+		db.page.nappend++
+		db.metrics.appended.Add(1)
 	}
 	db.page.updates[ptr] = node
 	return ptr
-	}
+}
 
-	// callback for BTree, deallocate a page.
+// callback for BTree, deallocate a page.
 func (db *KV) pageDel(ptr uint64) {
-	db.page.updates[ptr] = nil
+	if page := db.page.updates[ptr]; page != nil {
+		db.page.recycle = append(db.page.recycle, ptr)
 	}
+	db.page.updates[ptr] = nil
+	db.metrics.freed.Add(1)
+}
+
 // callback for FreeList, reuse a page.
 func (db *KV) pageUse(ptr uint64, node BNode) {
 	db.page.updates[ptr] = node
+}
+
+// io.WriterAt of whole pages over the page store
+type storeWriter struct {
+	store PageStore
+}
+
+func (w storeWriter) WriteAt(data []byte, offset int64) (int, error) {
+	assert(offset%BTREE_PAGE_SIZE == 0 && len(data)%BTREE_PAGE_SIZE == 0, "not a page")
+	pages := map[uint64][]byte{}
+	for i := 0; i < len(data); i += BTREE_PAGE_SIZE {
+		ptr := uint64(offset)/BTREE_PAGE_SIZE + uint64(i/BTREE_PAGE_SIZE)
+		pages[ptr] = clone(data[i : i+BTREE_PAGE_SIZE]) // the store may keep it
 	}
+	if err := w.store.WritePages(pages); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
 
 func createFileSync(file string) (int, error) {
 	// get dir fd
@@ -95,51 +148,266 @@ func createFileSync(file string) (int, error) {
 	return fd, nil
 
 }
-func extendMmap(db *KV, size int) error {
-	if size <= db.mmap.total {
-		return nil // enough range
-	}
-	alloc := max(db.mmap.total, 64<<20) // double the current address space
-	for db.mmap.total+alloc < size {
-		alloc *= 2 // still not enough?
-	}
-	chunk, err := syscall.Mmap(
-		db.fd, int64(db.mmap.total), alloc,
-		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
-	}
-	db.mmap.total += alloc
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
-	return nil
-}
+
 // callback for FreeList, allocate a new page.
 func (db *KV) pageAppend(node BNode) uint64 {
 	assert(len(node) <= BTREE_PAGE_SIZE, "node too big")
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
+	db.metrics.appended.Add(1)
 	db.page.updates[ptr] = node
 	return ptr
-	}
+}
 
-	func writePages(db *KV) error {
-		// update the free list
-		freed := []uint64{}
-		for ptr, page := range db.page.updates {
+func writePages(db *KV) error {
+	// update the free list
+	freed := []uint64{}
+	for ptr, page := range db.page.updates {
 		if page == nil {
-		freed = append(freed, ptr)
+			freed = append(freed, ptr)
 		}
-		}
-		db.free.Update(db.page.nfree, freed)
-		// extend the file & mmap if needed
-		// omitted...
-		// copy pages to the file
-		for ptr, page := range db.page.updates {
+	}
+	// the recycled pages are freed, so they can't house the list nodes
+	db.page.recycle = db.page.recycle[:0]
+	if len(db.pinned) > 0 {
+		// keep them out of the free list until the snapshots are released.
+		// the list is persisted, so they are not lost on a crash.
+		db.held.Update(0, freed)
+		freed = nil
+	} else {
+		freed = append(freed, db.held.takeAll()...)
+	}
+	db.free.Update(db.page.nfree, freed)
+	// write pages to the store
+	pages := map[uint64][]byte{}
+	for ptr, page := range db.page.updates {
 		if page != nil {
-		copy(pageGetMapped(db, ptr), page)
+			BNode(page).setGen(db.gen)
+			pages[ptr] = page[:BTREE_PAGE_SIZE]
 		}
 	}
+	if err := db.store.WritePages(pages); err != nil {
+		return err
+	}
+	db.page.flushed += db.page.nappend
+	discardPages(db)
+	return nil
+}
+
+// forget the pending updates of the current transaction
+func discardPages(db *KV) {
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.page.recycle = db.page.recycle[:0]
+}
+
+const DB_SIG = "dbfs-kv-store-v2"
+
+// the meta page:
+// | sig | root | page_used | free_list | seq | log_root | gen | comparator | catalog | key_id | held |
+// | 16B |  8B  |    8B     |    8B     | 8B  |    8B    | 8B  |    32B     |   8B    |   8B   |  8B  |
+// `key_id` is set by the encrypted store, 0 for no encryption.
+// `held` is a free list of the pages held for snapshots, which are
+// returned to the free list by the first commit after a reopen.
+const META_SIZE = 120
+
+func saveMeta(db *KV) []byte {
+	var data [META_SIZE]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.head)
+	binary.LittleEndian.PutUint64(data[40:], db.seq)
+	binary.LittleEndian.PutUint64(data[48:], db.cdc.tree.root)
+	binary.LittleEndian.PutUint64(data[56:], db.gen)
+	copy(data[64:], comparatorName(db.tree.cmp))
+	binary.LittleEndian.PutUint64(data[96:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[112:], db.held.head)
+	return data[:]
+}
+
+func loadMeta(db *KV, data []byte) {
+	db.tree.root = binary.LittleEndian.Uint64(data[16:])
+	db.page.flushed = binary.LittleEndian.Uint64(data[24:])
+	db.free.setHead(binary.LittleEndian.Uint64(data[32:]))
+	db.seq = binary.LittleEndian.Uint64(data[40:])
+	db.cdc.tree.root = binary.LittleEndian.Uint64(data[48:])
+	db.gen = binary.LittleEndian.Uint64(data[56:])
+	db.catalog.root = binary.LittleEndian.Uint64(data[96:])
+	db.held.setHead(binary.LittleEndian.Uint64(data[112:]))
+}
+
+var errBadMeta = errors.New("bad meta page")
+
+func readRoot(db *KV) error {
+	npages, err := db.store.Size()
+	if err != nil {
+		return err
+	}
+	if npages == 0 { // empty file
+		db.page.flushed = 1 // the meta page is initialized on the 1st write
+		return nil
+	}
+	// read the page
+	data, err := db.store.ReadPage(0)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data[:16], make([]byte, 16)) {
+		// crashed before the 1st meta page, the appended pages are garbage
+		db.page.flushed = 1
+		return nil
+	}
+	loadMeta(db, data)
+	// verify the page
+	bad := !bytes.Equal([]byte(DB_SIG), data[:16])
+	bad = bad || !(0 < db.page.flushed && db.page.flushed <= npages)
+	bad = bad || !(db.tree.root < db.page.flushed)
+	bad = bad || !(db.free.head < db.page.flushed)
+	bad = bad || !(db.cdc.tree.root < db.page.flushed)
+	bad = bad || !(db.catalog.root < db.page.flushed)
+	bad = bad || !(db.held.head < db.page.flushed)
+	if bad {
+		return errBadMeta
+	}
+	_, crypt := db.store.(*cryptStore)
+	if !crypt && binary.LittleEndian.Uint64(data[META_KEY_ID:]) != 0 {
+		return ErrEncrypted
+	}
+	return checkComparator(db, data)
+}
+
+func checkComparator(db *KV, meta []byte) error {
+	name := string(bytes.TrimRight(meta[64:96], "\x00"))
+	if name == "" {
+		name = Bytewise.Name // files from before comparators
+	}
+	if name != comparatorName(db.tree.cmp) {
+		return fmt.Errorf("%w: created with %q", ErrComparator, name)
+	}
 	return nil
+}
+
+// update the meta page. it must be atomic.
+func updateRoot(db *KV) error {
+	return writeMeta(db.store, saveMeta(db))
+}
+
+// the meta page is written alone as a full page
+func writeMeta(store PageStore, meta []byte) error {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, meta)
+	if err := store.WritePages(map[uint64][]byte{0: page}); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
 	}
+	return nil
+}
 
+func updateFile(db *KV) error {
+	m := &db.metrics
+	// 1. write new nodes
+	if err := m.writeTime.time(func() error { return writePages(db) }); err != nil {
+		return err
+	}
+	// 2. `fsync` to enforce the order between 1 and 3
+	if err := m.syncTime.time(db.store.Sync); err != nil {
+		return err
+	}
+	// 3. update the root pointer atomically
+	if err := m.metaTime.time(func() error { return updateRoot(db) }); err != nil {
+		return err
+	}
+	// 4. `fsync` to make everything persistent
+	return m.syncTime.time(db.store.Sync)
+}
+
+func updateOrRevert(db *KV, meta []byte) error {
+	// ensure the on-disk meta page matches the in-memory one after an error
+	err := error(nil)
+	if db.failed {
+		if err = writeMeta(db.store, meta); err == nil {
+			err = db.store.Sync()
+		}
+		if err == nil {
+			db.failed = false
+		} else {
+			err = fmt.Errorf("restore meta page: %w", err)
+		}
+	}
+	// 2-phase update
+	if err == nil {
+		err = updateFile(db)
+	}
+	// revert on error
+	if err != nil {
+		// the on-disk meta page is in an unknown state,
+		// mark it to be rewritten on the next update.
+		db.failed = true
+		// in-memory states are reverted immediately to allow reads
+		loadMeta(db, meta)
+		discardPages(db)
+	}
+	return err
+}
+
+// open or create a DB file, or open the page store
+func (db *KV) Open() error {
+	db.store = db.Store
+	if db.store == nil {
+		store, err := OpenFileStore(db.Path, db.IO, db.Write, db.CacheSize)
+		if err != nil {
+			return err
+		}
+		db.store = store
+	}
+	if db.Key != nil {
+		store, err := newCryptStore(db.store, db.Key)
+		if err != nil {
+			_ = db.Close()
+			return err
+		}
+		db.store = store
+	}
+	// page callbacks; the buckets get their own comparators
+	get := func(ptr uint64) []byte { return db.pageGet(ptr) }
+	new := func(node []byte) uint64 { return db.pageNew(node) }
+	db.tree = NewBTree(db.Comparator, get, new, db.pageDel)
+	db.cdc.tree = NewBTree(nil, get, new, db.pageDel)
+	db.catalog = NewBTree(nil, get, new, db.pageDel)
+	db.tree.codec = db.Compress
+	db.tree.compressMin = db.CompressMin
+	if db.tree.compressMin == 0 {
+		db.tree.compressMin = COMPRESS_MIN
+	}
+	db.free.get = db.pageGet
+	db.free.new = db.pageAppend
+	db.free.use = db.pageUse
+	db.free.setHead(0)
+	// the held pages are taken out of the free list, not reused
+	db.held = FreeList{get: db.pageGet, new: db.pageNew, use: db.pageUse, keep: true}
+	db.held.setHead(0)
+	db.tree.policy = db.Nodes
+	db.cdc.tree.policy = db.Nodes
+	db.catalog.policy = db.Nodes
+	db.tree.metrics = &db.metrics
+	db.cdc.tree.metrics = &db.metrics
+	db.catalog.metrics = &db.metrics
+	db.cdc.notify = make(chan struct{})
+	db.pinned = map[uint64]int{}
+	db.unpin.L = &db.mu
+	discardPages(db)
+	// read the meta page
+	if err := readRoot(db); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("%s: %w", db.Path, err)
+	}
+	return nil
+}
+
+// cleanups
+func (db *KV) Close() error {
+	err := db.store.Close()
+	db.store = nil
+	return err
+}
@@ -0,0 +1,216 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const DUMP_MAX_BYTES = 64 // longer keys and values are truncated
+
+// a key or value as a quoted string if it is printable, or as hex
+func formatBytes(data []byte, limit int) string {
+	short := data
+	if limit > 0 && len(short) > limit {
+		short = short[:limit]
+	}
+	s := ""
+	if utf8.Valid(short) && !bytes.ContainsFunc(short, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+		s = fmt.Sprintf("%q", short)
+	} else {
+		s = "0x" + hex.EncodeToString(short)
+	}
+	if len(short) < len(data) {
+		s += fmt.Sprintf("... (%d bytes)", len(data))
+	}
+	return s
+}
+
+// decode a page into readable text. a page can be the meta page (page 0),
+// a B-tree node, or a free list node.
+func DumpPage(w io.Writer, ptr uint64, page []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("page %d: corrupted: %v", ptr, r)
+		}
+	}()
+	b := &bytes.Buffer{}
+	node := BNode(page)
+	switch {
+	case ptr == 0:
+		dumpMeta(b, page)
+	case node.btype() == BNODE_NODE || node.btype() == BNODE_LEAF:
+		dumpNode(b, ptr, node)
+	case node.btype() == BNODE_FREE_LIST || node.btype() == BNODE_FREE_RUNS:
+		fmt.Fprintf(b, "page %d: free list, gen %d, size %d, total %d, next %d\n",
+			ptr, node.gen(), flnSize(node), flnTotal(node), flnNext(node))
+		for i := 0; i < flnSize(node); i++ {
+			run := flnRun(node, i)
+			fmt.Fprintf(b, "  [%d] pages %d-%d (%d)\n", i, run.start, run.start+run.count-1, run.count)
+		}
+	default:
+		fmt.Fprintf(b, "page %d: unknown type %d\n", ptr, node.btype())
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+func dumpMeta(b *bytes.Buffer, page []byte) {
+	fmt.Fprintf(b, "page 0: meta, sig %s\n", formatBytes(page[:16], 0))
+	fields := []string{"root", "page_used", "free_list", "seq", "log_root", "gen"}
+	for i, name := range fields {
+		fmt.Fprintf(b, "  %s %d\n", name, binary.LittleEndian.Uint64(page[16+8*i:]))
+	}
+	fmt.Fprintf(b, "  comparator %q\n", bytes.TrimRight(page[64:96], "\x00"))
+	fmt.Fprintf(b, "  catalog %d\n", binary.LittleEndian.Uint64(page[96:]))
+	fmt.Fprintf(b, "  key_id %#x\n", binary.LittleEndian.Uint64(page[META_KEY_ID:]))
+	fmt.Fprintf(b, "  held %d\n", binary.LittleEndian.Uint64(page[112:]))
+}
+
+func dumpNode(b *bytes.Buffer, ptr uint64, node BNode) {
+	kind := "leaf"
+	if node.btype() == BNODE_NODE {
+		kind = "internal"
+	}
+	nkeys := node.nkeys()
+	assert(BNODE_HEADER+10*int(nkeys) <= len(node), "too many keys")
+	fmt.Fprintf(b, "page %d: %s, gen %d, %d keys, %d bytes\n",
+		ptr, kind, node.gen(), nkeys, node.nbytes())
+	for i := uint16(0); i < nkeys; i++ {
+		fmt.Fprintf(b, "  [%d] offset %d", i, node.getOffset(i))
+		if node.btype() == BNODE_NODE {
+			fmt.Fprintf(b, " ptr %d", node.getPtr(i))
+		}
+		fmt.Fprintf(b, " key %s", formatBytes(node.getKey(i), DUMP_MAX_BYTES))
+		if node.btype() == BNODE_LEAF {
+			fmt.Fprintf(b, " val %s", formatBytes(node.getVal(i), DUMP_MAX_BYTES))
+			if stored, codec := node.getStoredVal(i); codec != CODEC_NONE {
+				fmt.Fprintf(b, " (%s, %d bytes)", codec, len(stored))
+			}
+		}
+		b.WriteByte('\n')
+	}
+}
+
+// decode a page of the last committed version
+func (db *KV) DumpPage(w io.Writer, ptr uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if ptr >= db.page.flushed {
+		return fmt.Errorf("page %d: %w", ptr, ErrPageRange)
+	}
+	page, err := db.store.ReadPage(ptr)
+	if err != nil {
+		return err
+	}
+	return DumpPage(w, ptr, page)
+}
+
+// the number of pages in use, including the meta page
+func (db *KV) NumPages() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.page.flushed
+}
+
+// escape a Graphviz record label
+func dotEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "{", `\{`, "}", `\}`,
+		"|", `\|`, "<", `\<`, ">", `\>`)
+	return r.Replace(s)
+}
+
+const DOT_MAX_KEYS = 8 // keys shown in a leaf
+
+type dotWriter struct {
+	b      *bytes.Buffer
+	inline int // counter for the ids of inline buckets
+}
+
+func (d *dotWriter) tree(name string, tree *BTree) {
+	name = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name)
+	fmt.Fprintf(d.b, "  subgraph \"cluster_%s\" {\n    label=\"%s\";\n", name, name)
+	if tree.root == ^uint64(0) {
+		d.inline++
+		d.node(fmt.Sprintf("inline%d", d.inline), "inline", BNode(tree.get(tree.root)))
+	} else if tree.root != 0 {
+		d.visit(tree, tree.root)
+	}
+	d.b.WriteString("  }\n")
+}
+
+func (d *dotWriter) visit(tree *BTree, ptr uint64) {
+	node := BNode(tree.get(ptr))
+	id := fmt.Sprintf("p%d", ptr)
+	d.node(id, fmt.Sprintf("page %d", ptr), node)
+	if node.btype() != BNODE_NODE {
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := node.getPtr(i)
+		fmt.Fprintf(d.b, "    %s:k%d -> p%d;\n", id, i, kid)
+		d.visit(tree, kid)
+	}
+}
+
+func (d *dotWriter) node(id string, title string, node BNode) {
+	fields := []string{fmt.Sprintf("%s\\ngen %d", title, node.gen())}
+	nkeys := node.nkeys()
+	for i := uint16(0); i < nkeys; i++ {
+		if node.btype() == BNODE_LEAF && i == DOT_MAX_KEYS && nkeys > DOT_MAX_KEYS+1 {
+			fields = append(fields, fmt.Sprintf("%d more", nkeys-1-i))
+			i = nkeys - 1 // the last key
+		}
+		key := dotEscape(formatBytes(node.getKey(i), 16))
+		fields = append(fields, fmt.Sprintf("<k%d> %s", i, key))
+	}
+	// internal nodes are laid out horizontally for the edges to the kids
+	label := strings.Join(fields, "|")
+	shape := "record"
+	if node.btype() == BNODE_LEAF {
+		label, shape = "{"+label+"}", "Mrecord"
+	}
+	fmt.Fprintf(d.b, "    %s [shape=%s, label=\"%s\"];\n", id, shape, label)
+}
+
+// render the trees and the free list of the last committed version as
+// Graphviz DOT
+func (db *KV) WriteDOT(w io.Writer) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupted node: %v", r)
+		}
+	}()
+	d := &dotWriter{b: &bytes.Buffer{}}
+	d.b.WriteString("digraph dbfs {\n  node [fontname=monospace, fontsize=10];\n")
+	d.tree("tree", &db.tree)
+	d.tree("change log", &db.cdc.tree)
+	d.tree("catalog", &db.catalog)
+	err = forEachBucket(&db.catalog, func(path []string, tree *BTree) error {
+		d.tree(fmt.Sprintf("bucket %q", path), tree)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.b.WriteString("  subgraph cluster_free_list {\n    label=\"free list\";\n")
+	for ptr := db.free.head; ptr != 0; {
+		node := db.free.get(ptr)
+		fmt.Fprintf(d.b, "    p%d [shape=box, label=\"page %d\\nfree list\\n%d runs, %d pages\"];\n",
+			ptr, ptr, flnSize(node), flnPages(node))
+		next := flnNext(node)
+		if next != 0 {
+			fmt.Fprintf(d.b, "    p%d -> p%d;\n", ptr, next)
+		}
+		ptr = next
+	}
+	d.b.WriteString("  }\n}\n")
+	_, err = w.Write(d.b.Bytes())
+	return err
+}
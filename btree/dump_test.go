@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func dumpString(t *testing.T, db *KV, ptr uint64) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := db.DumpPage(&buf, ptr); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func mustContain(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(out, line) {
+			t.Fatalf("no %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestDumpPage(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	setKeys(t, db, 200, strings.Repeat("v", 100))
+	setKeys(t, db, 10, "new") // some free pages
+	root := BNode(db.tree.get(db.tree.root))
+	if root.btype() != BNODE_NODE || db.free.head == 0 {
+		t.Fatalf("root type %d, free list %d", root.btype(), db.free.head)
+	}
+
+	mustContain(t, dumpString(t, db, 0),
+		`page 0: meta, sig "dbfs-kv-store-v2"`,
+		fmt.Sprintf("  root %d\n", db.tree.root),
+		fmt.Sprintf("  page_used %d\n", db.page.flushed),
+		fmt.Sprintf("  free_list %d\n", db.free.head),
+		fmt.Sprintf("  gen %d\n", db.gen),
+		`  comparator "bytewise"`,
+		"  held 0\n",
+	)
+	mustContain(t, dumpString(t, db, db.tree.root),
+		fmt.Sprintf("page %d: internal, gen %d, %d keys, %d bytes\n",
+			db.tree.root, root.gen(), root.nkeys(), root.nbytes()),
+		fmt.Sprintf("  [0] offset 0 ptr %d key \"\"\n", root.getPtr(0)),
+	)
+	leaf := BNode(db.tree.get(root.getPtr(0)))
+	mustContain(t, dumpString(t, db, root.getPtr(0)),
+		fmt.Sprintf("page %d: leaf, gen %d, %d keys", root.getPtr(0), leaf.gen(), leaf.nkeys()),
+		`  [0] offset 0 key "" val ""`,
+		`key "key0000" val "new"`,
+		fmt.Sprintf(`key "key0010" val "%s"... (100 bytes)`, strings.Repeat("v", DUMP_MAX_BYTES)),
+	)
+	free := BNode(db.free.get(db.free.head))
+	run := flnRun(free, 0)
+	mustContain(t, dumpString(t, db, db.free.head),
+		fmt.Sprintf("page %d: free list, gen %d, size %d, total %d, next 0\n",
+			db.free.head, free.gen(), flnSize(free), db.free.Total()),
+		fmt.Sprintf("  [0] pages %d-%d (%d)\n", run.start, run.start+run.count-1, run.count),
+	)
+
+	var buf bytes.Buffer
+	if err := db.DumpPage(&buf, db.NumPages()); !errors.Is(err, ErrPageRange) {
+		t.Fatalf("dump past the end: %v", err)
+	}
+	if err := DumpPage(&buf, 1, []byte{BNODE_LEAF, 0, 0xff, 0xff}); err == nil {
+		t.Fatal("no error for a corrupted node")
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	setKeys(t, db, 200, strings.Repeat("v", 100))
+	setKeys(t, db, 10, "new")
+	b, err := db.CreateBucket("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph dbfs {\n") || !strings.HasSuffix(out, "}\n}\n") {
+		t.Fatalf("not a graph:\n%s", out)
+	}
+	mustContain(t, out,
+		`subgraph "cluster_tree"`,
+		`subgraph "cluster_bucket [\"b\"]"`,
+		`    inline1 [shape=Mrecord, label="{inline\ngen 0|<k0> \"\"|<k1> \"k\"}"];`,
+		fmt.Sprintf("    p%d [shape=box, label=\"page %d\\nfree list", db.free.head, db.free.head),
+	)
+	// an edge to each kid of the root
+	root := BNode(db.tree.get(db.tree.root))
+	for i := uint16(0); i < root.nkeys(); i++ {
+		mustContain(t, out, fmt.Sprintf("    p%d:k%d -> p%d;\n", db.tree.root, i, root.getPtr(i)))
+	}
+	if n := strings.Count(out, " -> "); n != int(root.nkeys()) {
+		t.Fatalf("%d edges, the root has %d kids", n, root.nkeys())
+	}
+}
@@ -0,0 +1,180 @@
+package btree
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// A simulated disk for crash tests. Written pages are only durable after a
+// Sync; a crash drops, tears (at the sector level) or reorders the unsynced
+// writes at random. Faults are injected by counting the page writes and
+// syncs, so that a test can crash at every step of a workload.
+type FaultStore struct {
+	CrashAt    int // the op that crashes, all later ops fail. 0 for never.
+	FailSyncAt int // the sync that fails, the unsynced writes may be lost. 0 for never.
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	disk    [][]byte          // durable pages
+	cache   map[uint64][]byte // written but not synced, what reads see
+	pending []faultWrite      // unsynced writes in order
+	size    uint64
+	ops     int
+	syncs   int
+	crashed bool
+}
+
+type faultWrite struct {
+	ptr  uint64
+	page []byte
+}
+
+const FAULT_SECTOR = 512 // the unit of atomic writes
+
+var ErrInjected = errors.New("injected fault")
+
+func NewFaultStore(seed int64) *FaultStore {
+	return &FaultStore{rng: rand.New(rand.NewSource(seed)), cache: map[uint64][]byte{}}
+}
+
+// the number of page writes and syncs so far
+func (f *FaultStore) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// count an op, fails after the crash point
+func (f *FaultStore) step() error {
+	if f.crashed {
+		return ErrInjected
+	}
+	f.ops++
+	if f.ops == f.CrashAt {
+		f.crashed = true
+		return ErrInjected
+	}
+	return nil
+}
+
+func (f *FaultStore) ReadPage(ptr uint64) (BNode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if page, ok := f.cache[ptr]; ok {
+		return page, nil
+	}
+	if ptr >= f.size {
+		return nil, ErrPageRange
+	}
+	if ptr < uint64(len(f.disk)) && f.disk[ptr] != nil {
+		return f.disk[ptr], nil
+	}
+	return make([]byte, BTREE_PAGE_SIZE), nil // a hole
+}
+
+func (f *FaultStore) WritePages(pages map[uint64][]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ptr, page := range pages {
+		if err := f.step(); err != nil {
+			return err
+		}
+		page = clone(page[:BTREE_PAGE_SIZE])
+		f.cache[ptr] = page
+		f.pending = append(f.pending, faultWrite{ptr, page})
+		f.size = max(f.size, ptr+1)
+	}
+	return nil
+}
+
+func (f *FaultStore) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.step(); err != nil {
+		return err
+	}
+	f.syncs++
+	if f.syncs == f.FailSyncAt {
+		// like Linux, the failed writes are forgotten and may be lost,
+		// while the reads still see them.
+		for _, w := range f.pending {
+			if f.rng.Intn(2) == 0 {
+				f.persist(w.ptr, w.page)
+			}
+		}
+		f.pending = nil
+		return ErrInjected
+	}
+	for _, w := range f.pending {
+		f.persist(w.ptr, w.page)
+	}
+	f.pending = nil
+	f.cache = map[uint64][]byte{}
+	return nil
+}
+
+func (f *FaultStore) persist(ptr uint64, page []byte) {
+	for uint64(len(f.disk)) <= ptr {
+		f.disk = append(f.disk, nil)
+	}
+	f.disk[ptr] = page
+}
+
+func (f *FaultStore) Size() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size, nil
+}
+
+func (f *FaultStore) Truncate(npages uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.step(); err != nil {
+		return err
+	}
+	f.size = npages
+	if uint64(len(f.disk)) > npages {
+		f.disk = f.disk[:npages]
+	}
+	for ptr := range f.cache {
+		if ptr >= npages {
+			delete(f.cache, ptr)
+		}
+	}
+	return nil
+}
+
+func (f *FaultStore) Close() error {
+	return nil
+}
+
+// the disk after a power loss: each unsynced write is lost, written, or
+// torn, in a random order.
+func (f *FaultStore) Crash() *FaultStore {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	after := NewFaultStore(f.rng.Int63())
+	after.disk = append([][]byte{}, f.disk...)
+	for _, i := range f.rng.Perm(len(f.pending)) {
+		w := f.pending[i]
+		switch f.rng.Intn(3) {
+		case 0: // lost
+		case 1:
+			after.persist(w.ptr, w.page)
+		case 2:
+			page := make([]byte, BTREE_PAGE_SIZE)
+			if w.ptr < uint64(len(after.disk)) && after.disk[w.ptr] != nil {
+				copy(page, after.disk[w.ptr])
+			}
+			for off := 0; off < BTREE_PAGE_SIZE; off += FAULT_SECTOR {
+				if f.rng.Intn(2) == 0 {
+					copy(page[off:off+FAULT_SECTOR], w.page[off:])
+				}
+			}
+			after.persist(w.ptr, page)
+		}
+	}
+	after.size = uint64(len(after.disk))
+	return after
+}
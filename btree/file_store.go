@@ -0,0 +1,215 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// write the pages in file order
+func pwritePages(fd int, pages map[uint64][]byte) error {
+	for _, ptr := range slices.Sorted(maps.Keys(pages)) {
+		offset := int64(ptr * BTREE_PAGE_SIZE)
+		if _, err := syscall.Pwrite(fd, pages[ptr][:BTREE_PAGE_SIZE], offset); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+	return nil
+}
+
+// the write path of a file store
+type pageWriter interface {
+	writePages(pages map[uint64][]byte) error
+	close() error
+}
+
+// writes through the page cache
+type bufferedWriter struct {
+	fd int
+}
+
+func (w bufferedWriter) writePages(pages map[uint64][]byte) error {
+	return pwritePages(w.fd, pages)
+}
+
+func (w bufferedWriter) close() error {
+	return nil // the store's fd
+}
+
+func fileSize(fd int) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return uint64(st.Size) / BTREE_PAGE_SIZE, nil
+}
+
+func fsync(fd int) error {
+	if err := syscall.Fsync(fd); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func truncate(fd int, npages uint64) error {
+	if err := syscall.Ftruncate(fd, int64(npages*BTREE_PAGE_SIZE)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	return nil
+}
+
+// a file read through mmap
+type mmapStore struct {
+	fd     int
+	w      pageWriter
+	mu     sync.RWMutex // snapshots read while the mapping is extended
+	total  int          // mmap size, can be larger than the file size
+	chunks [][]byte     // multiple mmaps, can be non-continuous
+	grows  uint64       // number of extensions
+}
+
+func (m *mmapStore) extend(size int) error {
+	if size <= m.total {
+		return nil // enough range
+	}
+	alloc := max(m.total, 64<<20) // double the current address space
+	for m.total+alloc < size {
+		alloc *= 2 // still not enough?
+	}
+	chunk, err := syscall.Mmap(
+		m.fd, int64(m.total), alloc,
+		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	m.total += alloc
+	m.chunks = append(m.chunks, chunk)
+	m.grows++
+	return nil
+}
+
+// the number of extensions and the mapped size
+func (m *mmapStore) growth() (uint64, uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.grows, uint64(m.total)
+}
+
+func (m *mmapStore) ReadPage(ptr uint64) (BNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	start := uint64(0)
+	for _, chunk := range m.chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return BNode(chunk[offset : offset+BTREE_PAGE_SIZE]), nil
+		}
+		start = end
+	}
+	return nil, fmt.Errorf("read page %d: %w", ptr, ErrPageRange)
+}
+
+func (m *mmapStore) WritePages(pages map[uint64][]byte) error {
+	npages := uint64(0)
+	for ptr := range pages {
+		npages = max(npages, ptr+1)
+	}
+	m.mu.Lock()
+	err := m.extend(int(npages * BTREE_PAGE_SIZE))
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.w.writePages(pages)
+}
+
+func (m *mmapStore) Sync() error {
+	return fsync(m.fd)
+}
+
+func (m *mmapStore) Size() (uint64, error) {
+	return fileSize(m.fd)
+}
+
+func (m *mmapStore) Truncate(npages uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.extend(int(npages * BTREE_PAGE_SIZE)); err != nil {
+		return err
+	}
+	return truncate(m.fd, npages)
+}
+
+func (m *mmapStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, chunk := range m.chunks {
+		if err := syscall.Munmap(chunk); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
+	m.chunks = nil
+	m.total = 0
+	err := m.w.close()
+	if cerr := syscall.Close(m.fd); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// a file read with pread through a buffer pool
+type preadStore struct {
+	fd   int
+	w    pageWriter
+	pool *bufferPool
+}
+
+func (p *preadStore) ReadPage(ptr uint64) (BNode, error) {
+	if page := p.pool.get(ptr); page != nil {
+		return page, nil
+	}
+	page := make([]byte, BTREE_PAGE_SIZE)
+	n, err := syscall.Pread(p.fd, page, int64(ptr*BTREE_PAGE_SIZE))
+	if err == nil && n < BTREE_PAGE_SIZE {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read page %d: %w", ptr, err)
+	}
+	p.pool.put(ptr, page)
+	return page, nil
+}
+
+func (p *preadStore) WritePages(pages map[uint64][]byte) error {
+	// the pool is updated first, so it never holds an older version
+	for ptr, page := range pages {
+		p.pool.put(ptr, page[:BTREE_PAGE_SIZE])
+	}
+	return p.w.writePages(pages)
+}
+
+func (p *preadStore) Sync() error {
+	return fsync(p.fd)
+}
+
+func (p *preadStore) Size() (uint64, error) {
+	return fileSize(p.fd)
+}
+
+func (p *preadStore) Truncate(npages uint64) error {
+	p.pool.invalidate(npages)
+	return truncate(p.fd, npages)
+}
+
+func (p *preadStore) Close() error {
+	err := p.w.close()
+	if cerr := syscall.Close(p.fd); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -1,7 +1,9 @@
 package btree
 
 import (
+	"cmp"
 	"encoding/binary"
+	"slices"
 )
 
 // |	node1	|    |	node2	|	  |node3     |
@@ -9,38 +11,72 @@ import (
 // | total=xxx|	 |			|	     |			 |
 // | next=yyy | ==> | next=qqq | ==> | next=eee | ==> ...
 // | size=zzz |	 | size=ppp |	     | size=rrr |
-// | pointers |	 | pointers |	     | pointers |
+// | runs     |	 | runs     |	     | runs     |
 
 // The node format:
-// | type | size | total | next | pointers |
-// | 2B   |  2B  |  8B   |  8B  | size * 8B|
+// | type | size | gen | total | next |    runs     |
+// | 2B   |  2B  | 8B  |  8B   |  8B  | size * 12B  |
+// a run of contiguous free pages:
+// | start | count |
+// |  8B   |  4B   |
+// the total is only valid in the head node.
+//
+// The old format with single pages, which is still read:
+// | type | size | gen | total | next | pointers |
+// | 2B   |  2B  | 8B  |  8B   |  8B  | size * 8B|
 
 type LNode []byte
 
-const BNODE_FREE_LIST = 3
-const FREE_LIST_HEADER = 4+8+8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const BNODE_FREE_LIST = 3 // single pages, read only
+const BNODE_FREE_RUNS = 4
+const FREE_LIST_HEADER = BNODE_HEADER+8+8
+const FREE_LIST_CAP = (BTREE_NODE_MAX - FREE_LIST_HEADER) / 12
+const FREE_RUN_MAX = 1<<32 - 1
 
 func flnSize(node BNode) int{
 	return int(binary.LittleEndian.Uint16(node[2:4]))
 }
 func flnNext(node BNode) uint64{
-	return binary.BigEndian.Uint64(node[12:20])
+	return binary.LittleEndian.Uint64(node[20:28])
 }
-func flnPtr(node BNode, idx int) uint64{
-	off:= FREE_LIST_HEADER+idx*8
-	return binary.LittleEndian.Uint64(node[off:off+8])
+func flnTotal(node BNode) int {
+	return int(binary.LittleEndian.Uint64(node[12:20]))
 }
-func flnSetPtr(node BNode, idx int, ptr uint64){
-	off:= FREE_LIST_HEADER+idx*8
-	binary.LittleEndian.PutUint64(node[off:off+8],ptr)
+func flnRun(node BNode, idx int) freeRun {
+	if node.btype() == BNODE_FREE_LIST {
+		off := FREE_LIST_HEADER + idx*8
+		return freeRun{binary.LittleEndian.Uint64(node[off:]), 1}
+	}
+	off := FREE_LIST_HEADER + idx*12
+	start := binary.LittleEndian.Uint64(node[off:])
+	return freeRun{start, uint64(binary.LittleEndian.Uint32(node[off+8:]))}
+}
+func flnSetRun(node BNode, idx int, run freeRun){
+	off := FREE_LIST_HEADER + idx*12
+	binary.LittleEndian.PutUint64(node[off:], run.start)
+	binary.LittleEndian.PutUint32(node[off+8:], uint32(run.count))
 }
 func flnSetHeader(node BNode, size uint16, next uint64){
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_FREE_RUNS)
 	binary.LittleEndian.PutUint16(node[2:4], size)
-	binary.LittleEndian.PutUint64(node[12:20], next)
+	binary.LittleEndian.PutUint64(node[20:28], next)
 }
 func flnSetTotal(node BNode, total uint64){
-	binary.LittleEndian.PutUint64(node[4:12],total)
+	binary.LittleEndian.PutUint64(node[12:20],total)
+}
+// the number of free pages in a node
+func flnPages(node BNode) int {
+	n := 0
+	for i := 0; i < flnSize(node); i++ {
+		n += int(flnRun(node, i).count)
+	}
+	return n
+}
+
+// contiguous free pages
+type freeRun struct {
+	start uint64
+	count uint64
 }
 
 type FreeList struct {
@@ -50,32 +86,119 @@ type FreeList struct {
 	get func(uint64) BNode //derefernece a pointer
 	new func(BNode) uint64 //append a new page
 	use func(uint64,BNode) //reuse a page
+
+	// cached from the head node, -1 for unknown
+	total int
+	// the free pages are still read, so they can't house the list nodes
+	keep bool
+	// the position of the last Get, for sequential allocations
+	cursor struct {
+		valid bool
+		topn  int    // pages before the run
+		node  uint64 // the node of the run
+		idx   int    // the run in the node
+	}
+}
+
+// set the head, after loading or reverting the meta page
+func (fl *FreeList) setHead(head uint64) {
+	fl.head = head
+	fl.total = -1
+	fl.cursor.valid = false
 }
+
 // number of items in the list
 func (fl *FreeList) Total() int {
-    total := 0
-    node := fl.get(fl.head)
-    for node != nil {
-        total += flnSize(node)
-        next := flnNext(node)
-        if next == 0 {
-            break
-        }
-        node = fl.get(next)
-    }
-    return total
+	if fl.total < 0 {
+		fl.total = 0
+		if fl.head != 0 {
+			fl.total = flnTotal(fl.get(fl.head))
+		}
+	}
+	return fl.total
+}
+
+// the number of runs, which is the space the list takes
+func (fl *FreeList) Runs() int {
+	n := 0
+	for ptr := fl.head; ptr != 0; {
+		node := fl.get(ptr)
+		n += flnSize(node)
+		ptr = flnNext(node)
+	}
+	return n
 }
 
+// the `topn`th free page from the head
 func(fl *FreeList) Get(topn int) uint64{
+	start, _ := fl.GetRun(topn, 1)
+	return start
+}
+
+// up to `n` contiguous free pages from the `topn`th page. the pages are
+// taken in order, so a caller can take a longer run by skipping a short one.
+func (fl *FreeList) GetRun(topn int, n int) (uint64, int) {
 	assert(0<=topn && topn<fl.Total(), "freelist top out of range")
-	node:=fl.get(fl.head)
-	for flnSize(node)<=topn{
-		topn-=flnSize(node)
-		next:=flnNext(node)
-		assert(next!=0, "last node")
+	cur := &fl.cursor
+	if !cur.valid || topn < cur.topn {
+		// restart from the head
+		cur.valid, cur.topn, cur.node, cur.idx = true, 0, fl.head, 0
+	}
+	node := fl.get(cur.node)
+	for {
+		if cur.idx >= flnSize(node) {
+			cur.node, cur.idx = flnNext(node), 0
+			assert(cur.node != 0, "last node")
+			node = fl.get(cur.node)
+			continue
+		}
+		run := flnRun(node, cur.idx)
+		if skip := uint64(topn - cur.topn); skip < run.count {
+			return run.start + skip, int(min(uint64(n), run.count-skip))
+		}
+		cur.topn += int(run.count)
+		cur.idx++
+	}
+}
+
+// all free pages and the list nodes, which empties the list
+func (fl *FreeList) takeAll() []uint64 {
+	out := []uint64{}
+	for ptr := fl.head; ptr != 0; {
+		node := fl.get(ptr)
+		out = append(out, ptr)
+		for i := 0; i < flnSize(node); i++ {
+			run := flnRun(node, i)
+			for j := uint64(0); j < run.count; j++ {
+				out = append(out, run.start+j)
+			}
+		}
+		ptr = flnNext(node)
+	}
+	fl.setHead(0)
+	return out
+}
+
+// sort and coalesce runs
+func mergeRuns(runs []freeRun) []freeRun {
+	slices.SortFunc(runs, func(a, b freeRun) int { return cmp.Compare(a.start, b.start) })
+	out := runs[:0]
+	for _, run := range runs {
+		if last := len(out) - 1; last >= 0 && out[last].start+out[last].count == run.start &&
+			out[last].count+run.count <= FREE_RUN_MAX {
+			out[last].count += run.count
+		} else {
+			out = append(out, run)
+		}
 	}
-	return flnPtr(node, flnSize(node)-topn-1)
+	return out
 }
+
+// the number of nodes for `n` runs
+func flNodes(n int) int {
+	return (n + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+}
+
 // remove `popn` pointers and add some new pointers
 func (fl *FreeList) Update(popn int, freed []uint64) {
 	assert(popn <= fl.Total(), "popn too big")
@@ -84,52 +207,81 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 	}
 	// prepare to construct the new list
 	total := fl.Total()
-	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	fl.cursor.valid = false
+	pages := []freeRun{}
+	for _, ptr := range freed {
+		pages = append(pages, freeRun{ptr, 1})
+	}
+	// the rest of the removed nodes, which can house the new nodes, unlike
+	// the freed pages which are still used by the last version.
+	remain := []freeRun{}
+	nremain := 0
+	for fl.head != 0 {
 	node := fl.get(fl.head)
-	freed = append(freed, fl.head) // recyle the node itself
-	if popn >= flnSize(node) {
-	// phase 1
-	// remove all pointers in this node
-	popn -= flnSize(node)
-	} else {
-	// phase 2:
-	// remove some pointers
-	remain := flnSize(node) - popn
-	popn = 0
-	// reuse pointers from the free list itself
-	for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-	remain--
-	reuse = append(reuse, flnPtr(node, remain))
+	// remove nodes for the popped pages, for the pages to house the new
+	// nodes, or to merge a partial node into the new ones.
+	nruns := len(remain) + len(pages)
+	merge := nruns > 0 && flNodes(nruns+flnSize(node)+1) <= flNodes(nruns)
+	if popn == 0 && (fl.keep || nremain >= flNodes(nruns)) && !merge {
+	break
 	}
-	// move the node into the `freed` list
-	for i := 0; i < remain; i++ {
-	freed = append(freed, flnPtr(node, i))
+	pages = append(pages, freeRun{fl.head, 1}) // recyle the node itself
+	for i := 0; i < flnSize(node); i++ {
+	run := flnRun(node, i)
+	// phase 1: remove the popped pages from the front
+	skip := min(uint64(popn), run.count)
+	popn -= int(skip)
+	run.start, run.count = run.start+skip, run.count-skip
+	// phase 2: keep the rest
+	if run.count > 0 {
+	remain = append(remain, run)
+	nremain += int(run.count)
 	}
 	}
 	// discard the node and move to the next node
-	total -= flnSize(node)
+	total -= flnPages(node)
 	fl.head = flnNext(node)
 	}
-	assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0,"updating error")
+	assert(popn == 0, "updating error")
+	// take pages for the new nodes from the end of the remaining runs
+	reuse := []uint64{}
+	for !fl.keep && len(remain) > 0 && len(reuse) < flNodes(len(remain)+len(pages)) {
+		last := &remain[len(remain)-1]
+		last.count--
+		reuse = append(reuse, last.start+last.count)
+		if last.count == 0 {
+			remain = remain[:len(remain)-1]
+		}
+	}
+	runs := mergeRuns(append(remain, pages...))
+	for len(reuse) > flNodes(len(runs)) {
+		// taken too many
+		runs = mergeRuns(append(runs, freeRun{reuse[len(reuse)-1], 1}))
+		reuse = reuse[:len(reuse)-1]
+	}
+	for _, run := range runs {
+		total += int(run.count)
+	}
 	// phase 3: prepend new nodes
-	flPush(fl, freed, reuse)
+	flPush(fl, runs, reuse)
 	// done
-flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+	fl.total = total
+	if fl.head != 0 {
+		flnSetTotal(fl.get(fl.head), uint64(total))
+	}
 }
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
+
+// the lowest runs end up in the head node, so they are used first
+func flPush(fl *FreeList, runs []freeRun, reuse []uint64) {
+	for len(runs) > 0 {
 	new := BNode(make([]byte, BTREE_PAGE_SIZE))
-	// construct a new node
-	size := len(freed)
-	if size > FREE_LIST_CAP {
-	size = FREE_LIST_CAP
-	}
+	// construct a new node from the highest runs
+	size := len(runs) - (flNodes(len(runs))-1)*FREE_LIST_CAP
 	flnSetHeader(new, uint16(size), fl.head)
-	for i, ptr := range freed[:size] {
-	flnSetPtr(new, i, ptr)
+	for i, run := range runs[len(runs)-size:] {
+	flnSetRun(new, i, run)
 	}
-	freed = freed[size:]
+	runs = runs[:len(runs)-size]
 	if len(reuse) > 0 {
 	// reuse a pointer from the list
 	fl.head, reuse = reuse[0], reuse[1:]
@@ -140,4 +292,4 @@ func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
 	}
 	}
 	assert(len(reuse) == 0,"reuse empty")
-	}
\ No newline at end of file
+	}
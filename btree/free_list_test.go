@@ -0,0 +1,176 @@
+package btree
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// a free list over pages in memory
+type flTest struct {
+	fl    FreeList
+	pages map[uint64]BNode
+	next  uint64 // the next page to append
+}
+
+func newFLTest(keep bool, first uint64) *flTest {
+	f := &flTest{pages: map[uint64]BNode{}, next: first}
+	f.fl = FreeList{
+		get: func(ptr uint64) BNode {
+			node, ok := f.pages[ptr]
+			assert(ok, "get a missing page")
+			return node
+		},
+		new: func(node BNode) uint64 {
+			ptr := f.next
+			f.next++
+			f.pages[ptr] = node
+			return ptr
+		},
+		use: func(ptr uint64, node BNode) {
+			f.pages[ptr] = node
+		},
+		keep: keep,
+	}
+	return f
+}
+
+// the free pages and the list nodes by walking the list
+func (f *flTest) walk(t *testing.T) (free []uint64, nodes []uint64) {
+	t.Helper()
+	for ptr := f.fl.head; ptr != 0; {
+		node := f.fl.get(ptr)
+		nodes = append(nodes, ptr)
+		for i := 0; i < flnSize(node); i++ {
+			run := flnRun(node, i)
+			if run.count == 0 {
+				t.Fatalf("empty run in node %d", ptr)
+			}
+			for j := uint64(0); j < run.count; j++ {
+				free = append(free, run.start+j)
+			}
+		}
+		ptr = flnNext(node)
+	}
+	return free, nodes
+}
+
+func TestFreeListTotal(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		f := newFLTest(keep, 1)
+		rng := rand.New(rand.NewSource(1))
+		used := []uint64{} // the pages outside the list
+		for i := 0; i < 1000; i++ {
+			// take some pages in order, and free some used pages
+			popn := rng.Intn(min(f.fl.Total(), 50) + 1)
+			for j := 0; j < popn; j++ {
+				used = append(used, f.fl.Get(j))
+			}
+			freed := []uint64{}
+			nfree := rng.Intn(100)
+			if i%100 == 99 {
+				nfree = len(used) // free them all sometimes
+			}
+			rng.Shuffle(len(used)-popn, func(a, b int) { used[a], used[b] = used[b], used[a] })
+			for len(freed) < nfree && len(used) > popn {
+				freed = append(freed, used[0])
+				used = used[1:]
+			}
+			for j := rng.Intn(20); j > 0; j-- {
+				used = append(used, f.fl.new(nil)) // appended pages
+			}
+			f.fl.Update(popn, freed)
+			if i%10 == 0 {
+				f.fl.setHead(f.fl.head) // reopen
+			}
+			free, nodes := f.walk(t)
+			if f.fl.Total() != len(free) {
+				t.Fatalf("keep %v, step %d: total %d, walk %d", keep, i, f.fl.Total(), len(free))
+			}
+			// every page is either used, free, or a list node
+			all := slices.Concat(used, free, nodes)
+			slices.Sort(all)
+			if len(all) != int(f.next-1) || all[0] != 1 || all[len(all)-1] != f.next-1 {
+				t.Fatalf("keep %v, step %d: %d pages accounted, %d allocated", keep, i, len(all), f.next-1)
+			}
+			for j := 1; j < len(all); j++ {
+				if all[j] == all[j-1] {
+					t.Fatalf("keep %v, step %d: page %d twice", keep, i, all[j])
+				}
+			}
+		}
+	}
+}
+
+// the number of maximal runs of the free pages
+func (f *flTest) maxRuns(t *testing.T) int {
+	t.Helper()
+	free, _ := f.walk(t)
+	slices.Sort(free)
+	n := 0
+	for i := range free {
+		if i == 0 || free[i] != free[i-1]+1 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFreeListCoalesce(t *testing.T) {
+	f := newFLTest(false, 100)
+	f.fl.Update(0, []uint64{10, 11, 12, 20, 13})
+	if f.fl.Runs() != 2 || f.fl.Total() != 5 {
+		t.Fatalf("%d runs, %d pages", f.fl.Runs(), f.fl.Total())
+	}
+	// fill the gap. the last listed page houses the new node, and the old
+	// node is freed.
+	f.fl.Update(0, []uint64{16, 14, 19, 15, 17, 18})
+	if start, n := f.fl.GetRun(0, 100); start != 10 || n != 10 || f.fl.head != 20 {
+		t.Fatalf("run %d+%d, head %d", start, n, f.fl.head)
+	}
+	if f.fl.Runs() != f.maxRuns(t) || f.fl.Total() != 11 {
+		t.Fatalf("%d runs, %d pages", f.fl.Runs(), f.fl.Total())
+	}
+	// a run split by the popped pages
+	f.fl.Update(3, []uint64{30, 31})
+	if start, n := f.fl.GetRun(0, 100); start != 13 || n != 8 {
+		t.Fatalf("run %d+%d", start, n)
+	}
+	if f.fl.Runs() != f.maxRuns(t) {
+		t.Fatalf("%d runs, %d maximal", f.fl.Runs(), f.maxRuns(t))
+	}
+	// the pages around the runs, one of them houses the new node
+	f.fl.Update(0, []uint64{10, 11, 12, 21, 22, 23, 24, 25, 26, 27, 28, 29})
+	if start, n := f.fl.GetRun(0, 100); start != 10 || n < 10 {
+		t.Fatalf("run %d+%d", start, n)
+	}
+	if f.fl.Runs() != f.maxRuns(t) || f.fl.Runs() > 3 {
+		t.Fatalf("%d runs, %d maximal", f.fl.Runs(), f.maxRuns(t))
+	}
+}
+
+func TestFreeListContiguous(t *testing.T) {
+	f := newFLTest(false, 100)
+	f.fl.Update(0, []uint64{29, 10, 28, 11, 27, 12, 26, 13, 25, 14, 24, 23, 22, 21, 20})
+	// sequential allocations take adjacent pages
+	got := []uint64{}
+	for i := 0; i < f.fl.Total(); i++ {
+		got = append(got, f.fl.Get(i))
+	}
+	want := []uint64{10, 11, 12, 13, 14, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v", got)
+	}
+	for _, c := range []struct{ topn, n, start, count int }{
+		{0, 3, 10, 3},
+		{2, 10, 12, 3}, // up to the end of the run
+		{5, 8, 20, 8},
+		{1, 1, 11, 1}, // restarts from the head
+		{14, 5, 29, 1},
+	} {
+		start, n := f.fl.GetRun(c.topn, c.n)
+		if start != uint64(c.start) || n != c.count {
+			t.Fatalf("GetRun(%d, %d) = %d+%d", c.topn, c.n, start, n)
+		}
+	}
+}
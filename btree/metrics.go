@@ -0,0 +1,244 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// the upper bounds of the latency histogram buckets
+var LATENCY_BOUNDS = [...]time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond,
+	500 * time.Microsecond, time.Millisecond, 2500 * time.Microsecond,
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+}
+
+// a latency histogram, safe for concurrent use
+type histogram struct {
+	counts [len(LATENCY_BOUNDS) + 1]atomic.Uint64 // the last one is +Inf
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LATENCY_BOUNDS) && d > LATENCY_BOUNDS[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// time a function
+func (h *histogram) time(fn func() error) error {
+	start := time.Now()
+	err := fn()
+	h.observe(time.Since(start))
+	return err
+}
+
+type HistogramStats struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []uint64 // cumulative counts of each of LATENCY_BOUNDS
+}
+
+func (h *histogram) stats() HistogramStats {
+	stats := HistogramStats{Sum: time.Duration(h.sum.Load())}
+	for i := range h.counts {
+		stats.Count += h.counts[i].Load()
+		if i < len(LATENCY_BOUNDS) {
+			stats.Buckets = append(stats.Buckets, stats.Count)
+		}
+	}
+	return stats
+}
+
+// counters of a KV. the writer holds the KV lock, but the readers
+// and the Stats() caller don't, so they are atomic.
+type metrics struct {
+	gets, seeks, sets, dels atomic.Uint64
+	commits, aborts, failed atomic.Uint64
+	// page allocation
+	appended, reused, recycled, freed atomic.Uint64
+	// B-tree updates
+	splits2, splits3, merges, borrows atomic.Uint64
+	// value compression
+	compressed, compressIn, compressOut atomic.Uint64
+	// commit latency
+	commitTime, writeTime, syncTime, metaTime histogram
+}
+
+// count the nodes that an update is split into
+func (tree *BTree) countSplit(nsplit uint16) {
+	if tree.metrics == nil {
+		return
+	}
+	switch nsplit {
+	case 2:
+		tree.metrics.splits2.Add(1)
+	case 3:
+		tree.metrics.splits3.Add(1)
+	}
+}
+
+func (tree *BTree) countMerge() {
+	if tree.metrics != nil {
+		tree.metrics.merges.Add(1)
+	}
+}
+
+func (tree *BTree) countBorrow() {
+	if tree.metrics != nil {
+		tree.metrics.borrows.Add(1)
+	}
+}
+
+type Stats struct {
+	// operations by type
+	Gets, Seeks, Sets, Dels uint64
+	Commits, Aborts         uint64
+	FailedCommits           uint64
+	// page allocation
+	PagesAppended uint64 // at the end of the file
+	PagesReused   uint64 // from the free list
+	PagesRecycled uint64 // allocated and freed by the same transaction
+	PagesFreed    uint64
+	// B-tree nodes
+	Splits2, Splits3 uint64 // nodes split in 2 and in 3
+	Merges           uint64
+	Redistributions  uint64 // keys taken from a sibling instead of a merge
+	// value compression
+	CompressedVals   uint64 // values stored compressed
+	CompressInBytes  uint64 // their sizes before compression
+	CompressOutBytes uint64 // and after
+	// commit latency, in phases
+	CommitTime HistogramStats
+	WriteTime  HistogramStats // writing the pages
+	SyncTime   HistogramStats // each fsync
+	MetaTime   HistogramStats // writing the meta page
+	// page store
+	MmapGrowths uint64 // mmap extensions
+	MmapBytes   uint64 // the mapped address space
+	Pool        PoolStats
+}
+
+// a copy of the counters
+func (db *KV) Stats() Stats {
+	m := &db.metrics
+	stats := Stats{
+		Gets: m.gets.Load(), Seeks: m.seeks.Load(),
+		Sets: m.sets.Load(), Dels: m.dels.Load(),
+		Commits: m.commits.Load(), Aborts: m.aborts.Load(),
+		FailedCommits: m.failed.Load(),
+		PagesAppended: m.appended.Load(), PagesReused: m.reused.Load(),
+		PagesRecycled: m.recycled.Load(), PagesFreed: m.freed.Load(),
+		Splits2: m.splits2.Load(), Splits3: m.splits3.Load(),
+		Merges:           m.merges.Load(),
+		Redistributions:  m.borrows.Load(),
+		CompressedVals:   m.compressed.Load(),
+		CompressInBytes:  m.compressIn.Load(),
+		CompressOutBytes: m.compressOut.Load(),
+		CommitTime:       m.commitTime.stats(),
+		WriteTime:        m.writeTime.stats(),
+		SyncTime:         m.syncTime.stats(),
+		MetaTime:         m.metaTime.stats(),
+		Pool:             db.PoolStats(),
+	}
+	if store, ok := baseStore(db.store).(*mmapStore); ok {
+		stats.MmapGrowths, stats.MmapBytes = store.growth()
+	}
+	return stats
+}
+
+// write the stats in the Prometheus text format
+func (stats *Stats) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: w}
+	p.metric("dbfs_ops_total", "counter", "KV operations by type.")
+	p.sample(`{op="get"}`, stats.Gets)
+	p.sample(`{op="seek"}`, stats.Seeks)
+	p.sample(`{op="set"}`, stats.Sets)
+	p.sample(`{op="del"}`, stats.Dels)
+	p.sample(`{op="commit"}`, stats.Commits)
+	p.sample(`{op="abort"}`, stats.Aborts)
+	p.metric("dbfs_failed_commits_total", "counter", "Commits that failed to write.")
+	p.sample("", stats.FailedCommits)
+	p.metric("dbfs_pages_allocated_total", "counter", "Allocated pages by source.")
+	p.sample(`{source="append"}`, stats.PagesAppended)
+	p.sample(`{source="free_list"}`, stats.PagesReused)
+	p.sample(`{source="recycle"}`, stats.PagesRecycled)
+	p.metric("dbfs_pages_freed_total", "counter", "Freed pages.")
+	p.sample("", stats.PagesFreed)
+	p.metric("dbfs_node_splits_total", "counter", "B-tree node splits by the number of nodes.")
+	p.sample(`{nodes="2"}`, stats.Splits2)
+	p.sample(`{nodes="3"}`, stats.Splits3)
+	p.metric("dbfs_node_merges_total", "counter", "B-tree node merges.")
+	p.sample("", stats.Merges)
+	p.metric("dbfs_node_redistributions_total", "counter", "B-tree keys redistributed between siblings.")
+	p.sample("", stats.Redistributions)
+	p.metric("dbfs_compressed_values_total", "counter", "Values stored compressed.")
+	p.sample("", stats.CompressedVals)
+	p.metric("dbfs_compression_bytes_total", "counter", "Bytes of the compressed values, before and after.")
+	p.sample(`{stage="in"}`, stats.CompressInBytes)
+	p.sample(`{stage="out"}`, stats.CompressOutBytes)
+	p.metric("dbfs_commit_seconds", "histogram", "Commit latency by phase.")
+	p.histogram(`phase="total"`, stats.CommitTime)
+	p.histogram(`phase="write"`, stats.WriteTime)
+	p.histogram(`phase="fsync"`, stats.SyncTime)
+	p.histogram(`phase="meta"`, stats.MetaTime)
+	p.metric("dbfs_mmap_growths_total", "counter", "Extensions of the mmap address space.")
+	p.sample("", stats.MmapGrowths)
+	p.metric("dbfs_mmap_bytes", "gauge", "The mmap address space.")
+	p.sample("", stats.MmapBytes)
+	p.metric("dbfs_pool_requests_total", "counter", "Buffer pool lookups by result.")
+	p.sample(`{result="hit"}`, stats.Pool.Hits)
+	p.sample(`{result="miss"}`, stats.Pool.Misses)
+	p.metric("dbfs_pool_evictions_total", "counter", "Buffer pool evictions.")
+	p.sample("", stats.Pool.Evictions)
+	p.metric("dbfs_pool_pages", "gauge", "Cached pages.")
+	p.sample("", uint64(stats.Pool.Pages))
+	return p.err
+}
+
+// keeps the 1st error
+type promWriter struct {
+	w    io.Writer
+	name string
+	err  error
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) metric(name string, kind string, help string) {
+	p.name = name
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) sample(labels string, val uint64) {
+	p.printf("%s%s %d\n", p.name, labels, val)
+}
+
+func (p *promWriter) histogram(labels string, h HistogramStats) {
+	for i, count := range h.Buckets {
+		p.printf("%s_bucket{%s,le=\"%g\"} %d\n", p.name, labels, LATENCY_BOUNDS[i].Seconds(), count)
+	}
+	p.printf("%s_bucket{%s,le=\"+Inf\"} %d\n", p.name, labels, h.Count)
+	p.printf("%s_sum{%s} %g\n", p.name, labels, h.Sum.Seconds())
+	p.printf("%s_count{%s} %d\n", p.name, labels, h.Count)
+}
+
+// an HTTP handler of the Prometheus text format
+func (db *KV) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := db.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = stats.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,83 @@
+package btree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsPages(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	check := func(appended, reused, recycled, freed uint64) {
+		t.Helper()
+		s := db.Stats()
+		if s.PagesAppended != appended || s.PagesReused != reused ||
+			s.PagesRecycled != recycled || s.PagesFreed != freed {
+			t.Fatalf("appended %d, reused %d, recycled %d, freed %d",
+				s.PagesAppended, s.PagesReused, s.PagesRecycled, s.PagesFreed)
+		}
+	}
+	check(0, 0, 0, 0)
+	// the root leaf
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	check(1, 0, 0, 0)
+	// a copy of the leaf, and a free list node for the old one
+	if err := db.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	check(3, 0, 0, 1)
+	// the 1st copy reuses the free page, the next ones recycle it,
+	// and the free list node is appended
+	tx := db.Begin()
+	for _, key := range []string{"b", "c", "d"} {
+		if err := tx.Set([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 1, 2, 4)
+	if _, err := db.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 2, 2, 5)
+	db.Abort(db.Begin())
+
+	var buf bytes.Buffer
+	stats := db.Stats()
+	if err := stats.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# HELP dbfs_ops_total KV operations by type.",
+		"# TYPE dbfs_ops_total counter",
+		`dbfs_ops_total{op="set"} 5`,
+		`dbfs_ops_total{op="del"} 1`,
+		`dbfs_ops_total{op="commit"} 4`,
+		`dbfs_ops_total{op="abort"} 1`,
+		"dbfs_failed_commits_total 0",
+		`dbfs_pages_allocated_total{source="append"} 4`,
+		`dbfs_pages_allocated_total{source="free_list"} 2`,
+		`dbfs_pages_allocated_total{source="recycle"} 2`,
+		"dbfs_pages_freed_total 5",
+		"# TYPE dbfs_commit_seconds histogram",
+		`dbfs_commit_seconds_bucket{phase="total",le="+Inf"} 4`,
+		`dbfs_commit_seconds_count{phase="total"} 4`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("no line %q in:\n%s", line, out)
+		}
+	}
+	// the buckets are cumulative
+	last := uint64(0)
+	for _, n := range stats.CommitTime.Buckets {
+		if n < last || n > stats.CommitTime.Count {
+			t.Fatalf("buckets %v of %d", stats.CommitTime.Buckets, stats.CommitTime.Count)
+		}
+		last = n
+	}
+}
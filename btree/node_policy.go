@@ -0,0 +1,60 @@
+package btree
+
+// How full the nodes are kept. Splitting at the middle leaves the nodes
+// half full, which suits random inserts, but with ascending keys the left
+// node is never inserted into again, so the leaves stay half empty. A
+// right-biased split fills the left node instead, but with random keys it
+// leaves the right nodes nearly empty. See BenchmarkInsertFill.
+type SplitPolicy int
+
+const (
+	SPLIT_MIDDLE SplitPolicy = iota // half of the keys on each side
+	SPLIT_RIGHT                     // fill the left node up to SplitFill, only for ascending keys
+	SPLIT_APPEND                    // SPLIT_RIGHT when the key is the last one, or SPLIT_MIDDLE
+)
+
+const SPLIT_FILL = 0.9
+const MERGE_MAX = BTREE_PAGE_SIZE / 4
+
+// the zero value is the default
+type NodePolicy struct {
+	Split     SplitPolicy
+	SplitFill float64 // of the left node in right-biased splits, SPLIT_FILL by default
+	MergeMax  int     // merge a node of at most this many bytes, MERGE_MAX by default
+}
+
+func (p NodePolicy) splitFill() float64 {
+	if p.SplitFill <= 0 || p.SplitFill > 1 {
+		return SPLIT_FILL
+	}
+	return p.SplitFill
+}
+
+func (p NodePolicy) mergeMax() int {
+	if p.MergeMax <= 0 {
+		return MERGE_MAX
+	}
+	return p.MergeMax
+}
+
+// split an updated node by the policy. `key` is the inserted key,
+// nil for deletions.
+func (tree *BTree) split(node BNode, key []byte) (uint16, [3]BNode) {
+	leftMax := uint16(0)
+	if node.nbytes() > BTREE_NODE_MAX {
+		biased := false
+		switch tree.policy.Split {
+		case SPLIT_RIGHT:
+			biased = true
+		case SPLIT_APPEND:
+			// into the last kid for an internal node
+			biased = key != nil && tree.compare(key, node.getKey(node.nkeys()-1)) >= 0
+		}
+		if biased {
+			leftMax = uint16(tree.policy.splitFill() * BTREE_NODE_MAX)
+		}
+	}
+	nsplit, split := nodeSplit3(node, leftMax)
+	tree.countSplit(nsplit)
+	return nsplit, split
+}
@@ -0,0 +1,179 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var testPolicies = []struct {
+	name   string
+	policy NodePolicy
+}{
+	{"middle", NodePolicy{}},
+	{"right", NodePolicy{Split: SPLIT_RIGHT}},
+	{"right-full", NodePolicy{Split: SPLIT_RIGHT, SplitFill: 1}},
+	{"append", NodePolicy{Split: SPLIT_APPEND}},
+	{"append-merge-half", NodePolicy{Split: SPLIT_APPEND, MergeMax: BTREE_PAGE_SIZE / 2}},
+}
+
+func TestNodePolicies(t *testing.T) {
+	for _, p := range testPolicies {
+		t.Run(p.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			c := NewC()
+			c.tree.policy = p.policy
+			// ascending, then random
+			for i := 0; i < 1000; i++ {
+				c.Add(testKey(i), testVal(i, rng.Intn(500)))
+			}
+			c.verify(t)
+			randomOps(t, c, rng, 3000, 1500, BTREE_MAX_VAL_SIZE)
+			for key := range c.ref {
+				c.Del(key)
+			}
+			c.verify(t)
+		})
+	}
+}
+
+// the leaf fill after inserting keys in order or at random
+func BenchmarkInsertFill(b *testing.B) {
+	const N = 20000
+	for _, order := range []string{"sequential", "random"} {
+		for _, p := range testPolicies[:4] {
+			b.Run(order+"/"+p.name, func(b *testing.B) {
+				var shape TreeShape
+				for i := 0; i < b.N; i++ {
+					rng := rand.New(rand.NewSource(1))
+					ids := rng.Perm(N)
+					if order == "sequential" {
+						for j := range ids {
+							ids[j] = j
+						}
+					}
+					c := NewC()
+					c.tree.policy = p.policy
+					for _, id := range ids {
+						c.tree.Insert([]byte(fmt.Sprintf("key%08d", id)), []byte(testVal(id, 100)))
+					}
+					shape = treeShape(&c.tree, false)
+				}
+				leaves := shape.Levels[len(shape.Levels)-1]
+				b.ReportMetric(float64(shape.Pages()), "pages")
+				b.ReportMetric(100*leaves.Fill(), "leaf-fill-%")
+			})
+		}
+	}
+}
+
+// the nodes stay above MERGE_MAX bytes while most keys are deleted
+func TestDeleteFill(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	c := NewC()
+	ids := rng.Perm(5000)
+	for _, id := range ids {
+		c.Add(fmt.Sprintf("key%08d", id), testVal(id, 50+rng.Intn(100)))
+	}
+	for i, id := range ids[:4500] {
+		c.Del(fmt.Sprintf("key%08d", id))
+		if i%500 != 499 {
+			continue
+		}
+		c.verify(t)
+		shape := treeShape(&c.tree, false)
+		if fill := shape.Levels[len(shape.Levels)-1].Fill(); fill < 0.4 {
+			t.Fatalf("%d keys left: leaf fill %.2f", len(c.ref), fill)
+		}
+		var visit func(ptr uint64, depth int)
+		visit = func(ptr uint64, depth int) {
+			node := BNode(c.tree.get(ptr))
+			if depth > 0 && int(node.nbytes()) <= MERGE_MAX {
+				t.Fatalf("%d keys left: a node of %d bytes at depth %d", len(c.ref), node.nbytes(), depth)
+			}
+			for j := uint16(0); node.btype() == BNODE_NODE && j < node.nkeys(); j++ {
+				visit(node.getPtr(j), depth+1)
+			}
+		}
+		visit(c.tree.root, 0)
+	}
+}
+
+// a kid can't take keys from a sibling with 1 large KV
+func TestBorrowUnmoved(t *testing.T) {
+	c := NewC()
+	big := BNode(make([]byte, BTREE_PAGE_SIZE))
+	big.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(big, 0, 0, nil, nil)
+	bigKey := "a" + strings.Repeat("k", BTREE_MAX_KEY_SIZE-1)
+	nodeAppendKV(big, 1, 0, []byte(bigKey), []byte(testVal(0, BTREE_MAX_VAL_SIZE)))
+	small := BNode(make([]byte, BTREE_PAGE_SIZE))
+	small.setHeader(BNODE_LEAF, 10)
+	for i := uint16(0); i < 10; i++ {
+		nodeAppendKV(small, i, 0, []byte(fmt.Sprintf("b%d", i)), []byte(testVal(int(i), 90)))
+	}
+	root := BNode(make([]byte, BTREE_PAGE_SIZE))
+	root.setHeader(BNODE_NODE, 2)
+	left := c.tree.new(big)
+	nodeAppendKV(root, 0, left, nil, nil)
+	nodeAppendKV(root, 1, c.tree.new(small), small.getKey(0), nil)
+	c.tree.root = c.tree.new(root)
+	c.ref[bigKey] = testVal(0, BTREE_MAX_VAL_SIZE)
+	for i := 0; i < 10; i++ {
+		c.ref[fmt.Sprintf("b%d", i)] = testVal(i, 90)
+	}
+	c.verify(t)
+	// the right kid is underfull, but the 2 kids don't fit in 1 node
+	c.Del("b9")
+	if n := BNode(c.tree.get(c.tree.root)).getPtr(1); BNode(c.tree.get(n)).nbytes() > MERGE_MAX {
+		t.Fatal("the kid is not underfull")
+	}
+	if BNode(c.tree.get(c.tree.root)).getPtr(0) != left {
+		t.Fatal("the left kid is rewritten")
+	}
+	c.verify(t)
+}
+
+// merge and redistribute nearly full nodes, which must leave room for
+// the page trailer of an encrypted store
+func TestMergeMaxEncrypted(t *testing.T) {
+	db := openKV(t, &KV{
+		Store: NewMemStore(),
+		Key:   bytes.Repeat([]byte{1}, 32),
+		Nodes: NodePolicy{MergeMax: BTREE_PAGE_SIZE - 100},
+	})
+	rng := rand.New(rand.NewSource(3))
+	ref := map[string]string{}
+	for _, id := range rng.Perm(2000) {
+		key, val := testKey(id), testVal(id, rng.Intn(1000))
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	for i, id := range rng.Perm(2000)[:1800] {
+		if _, err := db.Del([]byte(testKey(id))); err != nil {
+			t.Fatal(err)
+		}
+		delete(ref, testKey(id))
+		if i%300 == 0 {
+			if err := db.Check(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stats().Redistributions == 0 {
+		t.Fatal("no keys are redistributed")
+	}
+	for key, val := range ref {
+		if got, ok := db.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("%.20s: %d bytes %v", key, len(got), ok)
+		}
+	}
+	checkPages(t, db)
+}
@@ -0,0 +1,131 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// Where the KV pages are persisted. Page 0 is the meta page, which is
+// written alone, after the other pages of a commit are synced.
+//
+// Reads can run concurrently with writes from snapshots. A written page must
+// not be modified by the caller, and a page returned by ReadPage must not be
+// modified by the store, so that the readers holding it see a stable copy.
+type PageStore interface {
+	// read a written page
+	ReadPage(ptr uint64) (BNode, error)
+	// write whole pages, the store may keep them
+	WritePages(pages map[uint64][]byte) error
+	// make the written pages durable
+	Sync() error
+	// the number of pages
+	Size() (uint64, error)
+	// drop the pages from `npages`
+	Truncate(npages uint64) error
+	Close() error
+}
+
+var ErrPageRange = errors.New("page out of range")
+
+// How a file store reads the written pages.
+type IOMode int
+
+const (
+	IO_MMAP  IOMode = iota // map the file, the OS manages the memory
+	IO_PREAD               // read pages into a bounded buffer pool
+)
+
+// How a file store writes the pages.
+type WriteMode int
+
+const (
+	WRITE_BUFFERED WriteMode = iota // pwrite through the page cache
+	WRITE_DIRECT                    // O_DIRECT, batched with io_uring or pwritev
+)
+
+// open a DB file as a page store
+func OpenFileStore(file string, mode IOMode, write WriteMode, cacheSize int) (PageStore, error) {
+	fd, err := createFileSync(file)
+	if err != nil {
+		return nil, err
+	}
+	w := pageWriter(bufferedWriter{fd})
+	if write == WRITE_DIRECT {
+		direct, err := openDirectWriter(file)
+		if err != nil {
+			_ = syscall.Close(fd)
+			return nil, err
+		}
+		w = direct
+	}
+	if mode == IO_PREAD {
+		return &preadStore{fd: fd, w: w, pool: newBufferPool(cacheSize)}, nil
+	}
+	store := &mmapStore{fd: fd, w: w}
+	size, err := store.Size()
+	if err == nil {
+		err = store.extend(int(size * BTREE_PAGE_SIZE))
+	}
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// pages in memory, for tests and temporary DBs
+type memStore struct {
+	mu    sync.RWMutex
+	pages [][]byte
+}
+
+func NewMemStore() PageStore {
+	return &memStore{}
+}
+
+func (m *memStore) ReadPage(ptr uint64) (BNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if ptr >= uint64(len(m.pages)) {
+		return nil, fmt.Errorf("read page %d: %w", ptr, ErrPageRange)
+	}
+	return m.pages[ptr], nil
+}
+
+func (m *memStore) WritePages(pages map[uint64][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ptr, page := range pages {
+		for uint64(len(m.pages)) <= ptr {
+			m.pages = append(m.pages, make([]byte, BTREE_PAGE_SIZE))
+		}
+		m.pages[ptr] = page[:BTREE_PAGE_SIZE]
+	}
+	return nil
+}
+
+func (m *memStore) Sync() error {
+	return nil
+}
+
+func (m *memStore) Size() (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return uint64(len(m.pages)), nil
+}
+
+func (m *memStore) Truncate(npages uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uint64(len(m.pages)) < npages {
+		m.pages = append(m.pages, make([]byte, BTREE_PAGE_SIZE))
+	}
+	m.pages = m.pages[:npages]
+	return nil
+}
+
+func (m *memStore) Close() error {
+	return nil
+}
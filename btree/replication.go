@@ -0,0 +1,291 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// Replication ships the pages of every commit from a primary to replicas.
+// The stream is a sequence of incremental backups: the replica sends the
+// generation it has, the primary replies with a backup of the pages written
+// since then, followed by one incremental backup per commit.
+//
+// The handshake from the replica, and the reply with the key order of the
+// primary, which is checked before any page is written:
+// | magic | gen |    | magic | comparator |
+// |  8B   | 8B  |    |  8B   |    32B     |
+// The replica sends nothing else, so the primary reads the connection only
+// to notice a replica that is gone.
+const REPL_MAGIC = "dbfsrpl1"
+
+// commits buffered for a slow replica before it is disconnected
+const REPL_QUEUE = 256
+
+var ErrReadOnly = errors.New("read-only replica")
+
+type replicaConn struct {
+	frames chan replFrame
+}
+
+// an encoded incremental backup of a single commit
+type replFrame struct {
+	gen  uint64
+	data []byte
+}
+
+// accept replicas until the listener is closed
+func (db *KV) ServeReplicas(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go db.serveReplica(conn)
+	}
+}
+
+func (db *KV) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	var hello [16]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return
+	}
+	if string(hello[:8]) != REPL_MAGIC {
+		return
+	}
+	since := binary.LittleEndian.Uint64(hello[8:])
+	// subscribe to new commits and pin the current version atomically
+	rc := &replicaConn{frames: make(chan replFrame, REPL_QUEUE)}
+	db.mu.Lock()
+	if since > db.gen {
+		db.mu.Unlock()
+		return // the replica is not from this primary
+	}
+	var reply [8 + MAX_COMPARATOR_NAME]byte
+	copy(reply[:8], REPL_MAGIC)
+	copy(reply[8:], comparatorName(db.tree.cmp))
+	if db.replicas == nil {
+		db.replicas = map[*replicaConn]struct{}{}
+	}
+	db.replicas[rc] = struct{}{}
+	snap := snapshot(db)
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		delete(db.replicas, rc)
+		db.mu.Unlock()
+	}()
+	// a slow replica doesn't block the commits
+	if _, err := conn.Write(reply[:]); err != nil {
+		_ = snap.Release()
+		return
+	}
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn) // returns when the connection breaks
+		close(gone)
+	}()
+	// catch up
+	err := snap.BackupSince(conn, since)
+	if rerr := snap.Release(); err != nil || rerr != nil {
+		return
+	}
+	// then follow the commits after the snapshot
+	for {
+		select {
+		case frame, ok := <-rc.frames:
+			if !ok {
+				return // dropped for being too slow
+			}
+			if frame.gen <= snap.Gen() {
+				continue
+			}
+			if _, err := conn.Write(frame.data); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// send a commit to the replicas, the caller holds the lock
+func publishCommit(db *KV, updates map[uint64][]byte) {
+	if len(db.replicas) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	bw := newBackupWriter(&buf, db.page.flushed, db.gen, db.gen-1)
+	for ptr, page := range updates {
+		if page != nil {
+			bw.page(ptr, page)
+		}
+	}
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, saveMeta(db))
+	bw.page(0, meta)
+	bw.finish()
+	frame := replFrame{gen: db.gen, data: buf.Bytes()}
+	for rc := range db.replicas {
+		select {
+		case rc.frames <- frame:
+		default:
+			// too slow, it will catch up after reconnecting
+			close(rc.frames)
+			delete(db.replicas, rc)
+		}
+	}
+}
+
+// a replica that was interrupted while catching up must resync everything.
+// a store without a path is not persistent and has no marker.
+func catchupMarker(db *KV) string {
+	return db.Path + ".catchup"
+}
+
+func setCatchup(db *KV) error {
+	if db.Path == "" {
+		return nil
+	}
+	fp, err := os.Create(catchupMarker(db))
+	if err == nil {
+		err = fp.Close()
+	}
+	return err
+}
+
+func inCatchup(db *KV) bool {
+	if db.Path == "" {
+		return false
+	}
+	_, err := os.Stat(catchupMarker(db))
+	return err == nil
+}
+
+func clearCatchup(db *KV) error {
+	if db.Path == "" {
+		return nil
+	}
+	if err := os.Remove(catchupMarker(db)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// apply the commits of a primary until the connection breaks.
+// the DB becomes read-only; call it again with a new connection to resume.
+func (db *KV) Follow(conn io.ReadWriter) error {
+	db.mu.Lock()
+	db.readonly = true
+	since := db.gen
+	db.mu.Unlock()
+	if inCatchup(db) {
+		since = 0
+	}
+	var hello [16]byte
+	copy(hello[:8], REPL_MAGIC)
+	binary.LittleEndian.PutUint64(hello[8:], since)
+	if _, err := conn.Write(hello[:]); err != nil {
+		return err
+	}
+	in := bufio.NewReader(conn)
+	var reply [8 + MAX_COMPARATOR_NAME]byte
+	if _, err := io.ReadFull(in, reply[:]); err != nil {
+		return err
+	}
+	if string(reply[:8]) != REPL_MAGIC {
+		return fmt.Errorf("%w: bad handshake", ErrBadBackup)
+	}
+	if name := string(bytes.TrimRight(reply[8:], "\x00")); name != comparatorName(db.tree.cmp) {
+		return fmt.Errorf("%w: the primary uses %q", ErrComparator, name)
+	}
+	for {
+		if err := applyFrame(db, in); err != nil {
+			return err
+		}
+	}
+}
+
+// apply an incremental backup to a live replica
+func applyFrame(db *KV, in io.Reader) error {
+	br := newBackupReader(in)
+	head, err := br.header()
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if head.since > db.gen || head.gen < db.gen {
+		return fmt.Errorf("%w: generation %d..%d does not follow %d",
+			ErrBadBackup, head.since, head.gen, db.gen)
+	}
+	var meta []byte
+	if head.gen <= head.since+1 {
+		// a single commit only overwrites pages that are free in the
+		// previous version, wait for the snapshots of older versions.
+		for minPinned(db) < head.since {
+			db.unpin.Wait()
+		}
+		db.mu.Unlock()
+		meta, err = br.apply(storeWriter{db.store}, head)
+		db.mu.Lock()
+	} else {
+		// pages of any older version can be overwritten, so wait for all
+		// snapshots and keep the readers out. the marker makes a crash in
+		// the middle of this recoverable.
+		for len(db.pinned) > 0 {
+			db.unpin.Wait()
+		}
+		if err = setCatchup(db); err == nil {
+			meta, err = br.apply(storeWriter{db.store}, head)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// pages at the end may be free and not included
+	if size, err := db.store.Size(); err != nil {
+		return err
+	} else if size < head.npages {
+		if err := db.store.Truncate(head.npages); err != nil {
+			return err
+		}
+	}
+	// make the new version visible
+	if err := db.store.Sync(); err != nil {
+		return err
+	}
+	if err := writeMeta(db.store, meta); err != nil {
+		return err
+	}
+	if err := db.store.Sync(); err != nil {
+		return err
+	}
+	seq := db.seq
+	loadMeta(db, meta)
+	if err := clearCatchup(db); err != nil {
+		return err
+	}
+	if db.seq != seq {
+		close(db.cdc.notify) // wake up subscribers
+		db.cdc.notify = make(chan struct{})
+	}
+	return nil
+}
+
+// the oldest pinned version
+func minPinned(db *KV) uint64 {
+	min := ^uint64(0)
+	for gen := range db.pinned {
+		if gen < min {
+			min = gen
+		}
+	}
+	return min
+}
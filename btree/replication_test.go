@@ -0,0 +1,148 @@
+package btree
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serve replicas of `primary` on a local port
+func listenReplicas(t *testing.T, primary *KV) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go primary.ServeReplicas(ln)
+	return ln.Addr().String()
+}
+
+// follow the primary in the background, the error is sent on return
+func follow(t *testing.T, replica *KV, addr string) (net.Conn, <-chan error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	done := make(chan error, 1)
+	go func() { done <- replica.Follow(conn) }()
+	return conn, done
+}
+
+// wait for the replica to have the same data as the primary
+func waitReplica(t *testing.T, primary *KV, replica *KV) {
+	t.Helper()
+	want := dumpKV(primary)
+	deadline := time.Now().Add(10 * time.Second)
+	for !maps.Equal(dumpKV(replica), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the replica has %d keys, the primary %d", len(dumpKV(replica)), len(want))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplicationFile(t *testing.T) {
+	dir := t.TempDir()
+	primary := openKV(t, &KV{Path: filepath.Join(dir, "primary")})
+	replica := openKV(t, &KV{Path: filepath.Join(dir, "replica")})
+	setKeys(t, primary, 100, "v0")
+	addr := listenReplicas(t, primary)
+	follow(t, replica, addr)
+	waitReplica(t, primary, replica)
+	// commits after the catch-up
+	for i := 0; i < 5; i++ {
+		setKeys(t, primary, 100+i, "v1")
+		waitReplica(t, primary, replica)
+	}
+	if inCatchup(replica) {
+		t.Fatal("the catch-up marker is left")
+	}
+}
+
+func numReplicas(db *KV) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.replicas)
+}
+
+func TestReplicationReconnect(t *testing.T) {
+	dir := t.TempDir()
+	primary := openKV(t, &KV{Path: filepath.Join(dir, "primary")})
+	replica := openKV(t, &KV{Path: filepath.Join(dir, "replica")})
+	addr := listenReplicas(t, primary)
+	setKeys(t, primary, 50, "v0")
+	conn, done := follow(t, replica, addr)
+	waitReplica(t, primary, replica)
+	if err := replica.Set([]byte("key"), []byte("val")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("write to a replica: %v", err)
+	}
+
+	// the primary notices a replica that is gone without any commits
+	conn.Close()
+	if err := <-done; err == nil {
+		t.Fatal("follow returned no error")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for numReplicas(primary) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the primary still has the replica")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// several commits while disconnected, then catch up
+	gen := replica.gen
+	for i := 0; i < 10; i++ {
+		setKeys(t, primary, 60+10*i, "v1")
+	}
+	if _, err := primary.Del([]byte("key0000")); err != nil {
+		t.Fatal(err)
+	}
+	follow(t, replica, addr)
+	waitReplica(t, primary, replica)
+	if inCatchup(replica) {
+		t.Fatal("the catch-up marker is left")
+	}
+	if err := replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the replica file is consistent after a reopen
+	replica = openKV(t, &KV{Path: filepath.Join(dir, "replica")})
+	if replica.gen <= gen {
+		t.Fatalf("replica at generation %d after catching up from %d", replica.gen, gen)
+	}
+	checkPages(t, replica)
+	if !maps.Equal(dumpKV(replica), dumpKV(primary)) {
+		t.Fatal("the reopened replica differs")
+	}
+}
+
+func TestReplicationComparator(t *testing.T) {
+	dir := t.TempDir()
+	primary := openKV(t, &KV{Path: filepath.Join(dir, "primary"), Comparator: Reverse})
+	setKeys(t, primary, 50, "primary")
+	replica := openKV(t, &KV{Path: filepath.Join(dir, "replica")})
+	setKeys(t, replica, 20, "replica")
+	want, gen := dumpKV(replica), replica.gen
+
+	addr := listenReplicas(t, primary)
+	_, done := follow(t, replica, addr)
+	if err := <-done; !errors.Is(err, ErrComparator) {
+		t.Fatalf("follow: %v", err)
+	}
+	// nothing is written
+	if err := replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replica = openKV(t, &KV{Path: filepath.Join(dir, "replica")})
+	if replica.gen != gen || !maps.Equal(dumpKV(replica), want) {
+		t.Fatal("the replica is modified")
+	}
+	checkPages(t, replica)
+}
@@ -0,0 +1,88 @@
+package btree
+
+// A read-only view of a committed version. Pages are copy-on-write, so the
+// old roots are a consistent snapshot as long as the pages they reach are
+// not reused, which is ensured by holding back freed pages until release.
+type Snapshot struct {
+	db     *KV
+	meta   []byte
+	seq    uint64
+	gen    uint64
+	npages uint64
+	tree   BTree
+	log    BTree
+	cat    BTree // the bucket catalog
+	free   map[uint64]BNode // copies of the free and held list nodes, which are reused eagerly
+	done   bool
+}
+
+// pin the last committed version, blocks while a transaction is active
+func (db *KV) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return snapshot(db)
+}
+
+// the caller holds the lock
+func snapshot(db *KV) *Snapshot {
+	db.pinned[db.gen]++
+	snap := &Snapshot{
+		db:     db,
+		meta:   saveMeta(db),
+		seq:    db.seq,
+		gen:    db.gen,
+		npages: db.page.flushed,
+		free:   map[uint64]BNode{},
+	}
+	store := db.store
+	get := func(ptr uint64) []byte { return readPage(store, ptr) }
+	snap.tree = BTree{root: db.tree.root, get: get, cmp: db.tree.cmp}
+	snap.log = BTree{root: db.cdc.tree.root, get: get}
+	snap.cat = BTree{root: db.catalog.root, get: get}
+	for _, fl := range []*FreeList{&db.free, &db.held} {
+		for ptr := fl.head; ptr != 0; {
+			node := fl.get(ptr)
+			snap.free[ptr] = clone(node)
+			ptr = flnNext(node)
+		}
+	}
+	return snap
+}
+
+// unpin the version and give the held pages back to the free list
+func (snap *Snapshot) Release() error {
+	if snap.done {
+		return nil
+	}
+	snap.done = true
+	db := snap.db
+	tx := db.Begin()
+	if db.pinned[snap.gen]--; db.pinned[snap.gen] == 0 {
+		delete(db.pinned, snap.gen)
+	}
+	db.unpin.Broadcast()
+	return db.Commit(tx)
+}
+
+// the sequence number of the last commit with changes in this version
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// the generation of the last commit in this version
+func (snap *Snapshot) Gen() uint64 {
+	return snap.gen
+}
+
+func (snap *Snapshot) Get(key []byte) ([]byte, bool) {
+	assert(!snap.done, "snapshot released")
+	snap.db.metrics.gets.Add(1)
+	return snap.tree.Get(key)
+}
+
+// the first key that is greater or equal to the input key
+func (snap *Snapshot) Seek(key []byte) *BIter {
+	assert(!snap.done, "snapshot released")
+	snap.db.metrics.seeks.Add(1)
+	return snap.tree.SeekGE(key)
+}
@@ -0,0 +1,143 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// every page of the file is either used, free, or held for snapshots
+func checkPages(t *testing.T, db *KV) TreeStats {
+	t.Helper()
+	stats, err := db.TreeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := 1 + stats.TreePages() + stats.FreeListPages + stats.FreePages + stats.HeldPages
+	if uint64(used) != stats.FilePages {
+		t.Fatalf("%d pages accounted for, %d in the file: %+v", used, stats.FilePages, stats)
+	}
+	return stats
+}
+
+func setKeys(t *testing.T, db *KV, n int, val string) {
+	t.Helper()
+	tx := db.Begin()
+	for i := 0; i < n; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	setKeys(t, db, 500, "old")
+	snap := db.Snapshot()
+	gen := snap.Gen()
+	// overwrite, delete and add keys while the snapshot is pinned
+	for i := 0; i < 5; i++ {
+		setKeys(t, db, 500, fmt.Sprintf("new%d", i))
+	}
+	for i := 0; i < 500; i += 2 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set([]byte("added"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := checkPages(t, db); stats.HeldPages == 0 {
+		t.Fatal("no pages are held for the snapshot")
+	}
+	// the snapshot still sees the old version
+	n := 0
+	for iter := snap.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) > 0 && string(val) != "old" {
+			t.Fatalf("%q = %q", key, val)
+		}
+		n += min(len(key), 1)
+	}
+	if n != 500 {
+		t.Fatalf("%d keys in the snapshot", n)
+	}
+	if _, ok := snap.Get([]byte("added")); ok {
+		t.Fatal("a later key in the snapshot")
+	}
+	if snap.Gen() != gen {
+		t.Fatal("snapshot generation changed")
+	}
+	// the held pages go back to the free list
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := checkPages(t, db); stats.HeldPages != 0 {
+		t.Fatalf("%d pages held after release", stats.HeldPages)
+	}
+}
+
+func TestSnapshotHeldAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openKV(t, &KV{Path: path})
+	setKeys(t, db, 500, "old")
+	_ = db.Snapshot() // never released
+	setKeys(t, db, 500, "new")
+	held := checkPages(t, db).HeldPages
+	if held == 0 {
+		t.Fatal("no pages are held for the snapshot")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the held pages are persisted and reclaimed by the next commit
+	db = openKV(t, &KV{Path: path})
+	if n := checkPages(t, db).HeldPages; n != held {
+		t.Fatalf("%d pages held after reopen, want %d", n, held)
+	}
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	after := checkPages(t, db)
+	if after.HeldPages != 0 || after.FreePages < held {
+		t.Fatalf("held %d, free %d after a commit", after.HeldPages, after.FreePages)
+	}
+}
+
+func TestSnapshotHeldRecycled(t *testing.T) {
+	db := openKV(t, &KV{Path: filepath.Join(t.TempDir(), "db")})
+	setKeys(t, db, 500, "old")
+	snap := db.Snapshot()
+	// pages allocated and freed by the same transaction
+	tx := db.Begin()
+	for i := 0; i < 500; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 500; i += 2 {
+		if _, err := tx.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.page.recycle) == 0 {
+		t.Fatal("no page is recycled")
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	setKeys(t, db, 10, "after")
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, db)
+}
@@ -2,6 +2,9 @@ package btree
 
 import (
 	"fmt"
+	"maps"
+	"os"
+	"slices"
 	"unsafe"
 )
 
@@ -26,7 +29,7 @@ func NewC() *C {
 				return node
 			},
 			new: func(node []byte) uint64 {
-				assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE, "new node too big")
+				assert(BNode(node).nbytes() <= BTREE_NODE_MAX, "new node too big")
 				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
 				assert(pages[ptr] == nil, "empty ptr")
 				pages[ptr] = node
@@ -50,10 +53,9 @@ func (c *C) Del(key string) bool {
 	return c.tree.Delete([]byte(key))
 }
 func (c *C) PrintTree() {
-	// fmt.Printf("Root page: %d\n", c.pages[c.tree.root])
-	fmt.Println("Pages:")
-	for pt, node := range c.pages {
-		fmt.Println("Pointer:", pt)
-		fmt.Println("BNode data:", node)
+	for _, ptr := range slices.Sorted(maps.Keys(c.pages)) {
+		if err := DumpPage(os.Stdout, ptr, c.pages[ptr]); err != nil {
+			fmt.Println(err)
+		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,225 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var (
+	ErrKeySize = errors.New("bad key size")
+	ErrValSize = errors.New("value too big")
+)
+
+// KV transaction, only one can be active at a time
+type KVTX struct {
+	db      *KV
+	meta    []byte   // for the rollback
+	changes []Change // for the change log
+	done    bool
+}
+
+// begin a transaction, blocks until the previous one is finished
+func (db *KV) Begin() *KVTX {
+	db.mu.Lock()
+	return &KVTX{db: db, meta: saveMeta(db)}
+}
+
+// end a transaction: commit updates
+func (db *KV) Commit(tx *KVTX) error {
+	assert(!tx.done, "transaction already finished")
+	tx.done = true
+	defer db.mu.Unlock()
+	db.metrics.commits.Add(1)
+	if len(db.page.updates) == 0 && (len(db.pinned) > 0 || db.held.head == 0) && !db.failed {
+		return nil // nothing to do, and the meta page is intact
+	}
+	if db.readonly {
+		loadMeta(db, tx.meta)
+		discardPages(db)
+		return ErrReadOnly
+	}
+	db.gen++
+	if len(tx.changes) > 0 {
+		db.seq++
+		if err := logChanges(db, db.seq, tx.changes); err != nil {
+			loadMeta(db, tx.meta)
+			discardPages(db)
+			return err
+		}
+	}
+	updates := db.page.updates // including the free list, for the replicas
+	start := time.Now()
+	err := updateOrRevert(db, tx.meta)
+	db.metrics.commitTime.observe(time.Since(start))
+	if err != nil {
+		db.metrics.failed.Add(1)
+		return err
+	}
+	publishCommit(db, updates)
+	if len(tx.changes) > 0 {
+		close(db.cdc.notify) // wake up subscribers
+		db.cdc.notify = make(chan struct{})
+	}
+	return nil
+}
+
+// end a transaction: rollback
+func (db *KV) Abort(tx *KVTX) {
+	assert(!tx.done, "transaction already finished")
+	tx.done = true
+	defer db.mu.Unlock()
+	db.metrics.aborts.Add(1)
+	loadMeta(db, tx.meta)
+	discardPages(db)
+}
+
+// read a key, the value is only valid until the transaction ends
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	assert(!tx.done, "transaction already finished")
+	tx.db.metrics.gets.Add(1)
+	return tx.db.tree.Get(key)
+}
+
+// the first key that is greater or equal to the input key
+func (tx *KVTX) Seek(key []byte) *BIter {
+	assert(!tx.done, "transaction already finished")
+	tx.db.metrics.seeks.Add(1)
+	return tx.db.tree.SeekGE(key)
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	return tx.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// set a key by the mode of the request, the old value is a copy
+func (tx *KVTX) Update(req *UpdateReq) error {
+	assert(!tx.done, "transaction already finished")
+	if len(req.Key) == 0 || len(req.Key) > BTREE_MAX_KEY_SIZE {
+		return ErrKeySize
+	}
+	if len(req.Val) > BTREE_MAX_VAL_SIZE {
+		return ErrValSize
+	}
+	tx.db.metrics.sets.Add(1)
+	if err := tx.db.tree.Update(req); err != nil {
+		return err
+	}
+	req.Old = clone(req.Old)
+	if req.Status != STATUS_UNCHANGED {
+		change := Change{Op: OpPut, Key: clone(req.Key), New: clone(req.Val), Old: req.Old}
+		tx.changes = append(tx.changes, change)
+	}
+	return nil
+}
+
+// replace the value of an existing key if it is `expected`
+func (tx *KVTX) CompareAndSwap(key []byte, expected []byte, val []byte) (bool, error) {
+	assert(!tx.done, "transaction already finished")
+	if old, exists := tx.db.tree.Get(key); !exists || !bytes.Equal(old, expected) {
+		return false, nil
+	}
+	if err := tx.Update(&UpdateReq{Key: key, Val: val, Mode: MODE_UPDATE_ONLY}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// add a key if it doesn't exist
+func (tx *KVTX) SetIfAbsent(key []byte, val []byte) (bool, error) {
+	req := &UpdateReq{Key: key, Val: val, Mode: MODE_INSERT_ONLY}
+	if err := tx.Update(req); err != nil {
+		return false, err
+	}
+	return req.Status == STATUS_ADDED, nil
+}
+
+// delete a key if its value is `expected`
+func (tx *KVTX) DeleteIfEquals(key []byte, expected []byte) (bool, error) {
+	assert(!tx.done, "transaction already finished")
+	if old, exists := tx.db.tree.Get(key); !exists || !bytes.Equal(old, expected) {
+		return false, nil
+	}
+	return tx.Del(key)
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	assert(!tx.done, "transaction already finished")
+	if len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE {
+		return false, ErrKeySize
+	}
+	tx.db.metrics.dels.Add(1)
+	old, exists := tx.db.tree.Get(key)
+	if !exists {
+		return false, nil
+	}
+	change := Change{Op: OpDel, Key: clone(key), Old: clone(old)}
+	tx.db.tree.Delete(key)
+	tx.changes = append(tx.changes, change)
+	return true, nil
+}
+
+// read a key from the last committed version
+func (db *KV) Get(key []byte) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.metrics.gets.Add(1)
+	val, ok := db.tree.Get(key)
+	return clone(val), ok
+}
+
+// single-key transactions
+func (db *KV) Set(key []byte, val []byte) error {
+	tx := db.Begin()
+	if err := tx.Set(key, val); err != nil {
+		db.Abort(tx)
+		return err
+	}
+	return db.Commit(tx)
+}
+
+func (db *KV) Del(key []byte) (bool, error) {
+	return db.update(func(tx *KVTX) (bool, error) { return tx.Del(key) })
+}
+
+func (db *KV) Update(req *UpdateReq) error {
+	_, err := db.update(func(tx *KVTX) (bool, error) {
+		err := tx.Update(req)
+		return req.Status != STATUS_UNCHANGED, err
+	})
+	return err
+}
+
+func (db *KV) CompareAndSwap(key []byte, expected []byte, val []byte) (bool, error) {
+	return db.update(func(tx *KVTX) (bool, error) { return tx.CompareAndSwap(key, expected, val) })
+}
+
+func (db *KV) SetIfAbsent(key []byte, val []byte) (bool, error) {
+	return db.update(func(tx *KVTX) (bool, error) { return tx.SetIfAbsent(key, val) })
+}
+
+func (db *KV) DeleteIfEquals(key []byte, expected []byte) (bool, error) {
+	return db.update(func(tx *KVTX) (bool, error) { return tx.DeleteIfEquals(key, expected) })
+}
+
+// a single-key transaction, it is aborted if `fn` changes nothing
+func (db *KV) update(fn func(tx *KVTX) (bool, error)) (bool, error) {
+	tx := db.Begin()
+	changed, err := fn(tx)
+	if err != nil || !changed {
+		db.Abort(tx)
+		return false, err
+	}
+	if err := db.Commit(tx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copy a slice that may point into a page
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,209 @@
+package btree
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// sizes in powers of 2, Counts[i] is the number of sizes in [2^(i-1), 2^i),
+// and Counts[0] is the number of empty ones.
+type SizeDist struct {
+	Counts []uint64
+	N      uint64
+	Total  uint64 // sum of sizes
+	Max    int
+}
+
+func (d *SizeDist) add(size int) {
+	i := bits.Len(uint(size))
+	for len(d.Counts) <= i {
+		d.Counts = append(d.Counts, 0)
+	}
+	d.Counts[i]++
+	d.N++
+	d.Total += uint64(size)
+	d.Max = max(d.Max, size)
+}
+
+func (d *SizeDist) merge(other SizeDist) {
+	for i, n := range other.Counts {
+		for len(d.Counts) <= i {
+			d.Counts = append(d.Counts, 0)
+		}
+		d.Counts[i] += n
+	}
+	d.N += other.N
+	d.Total += other.Total
+	d.Max = max(d.Max, other.Max)
+}
+
+func (d SizeDist) Mean() float64 {
+	if d.N == 0 {
+		return 0
+	}
+	return float64(d.Total) / float64(d.N)
+}
+
+// the nodes at one depth of a tree
+type LevelStats struct {
+	Pages int
+	Keys  int
+	Bytes int // used by the nodes
+}
+
+// the used fraction of the pages
+func (l LevelStats) Fill() float64 {
+	if l.Pages == 0 {
+		return 0
+	}
+	return float64(l.Bytes) / float64(l.Pages*BTREE_PAGE_SIZE)
+}
+
+// the structure of a B-tree
+type TreeShape struct {
+	Height   int
+	Internal int // pages
+	Leaves   int // pages, 0 for an inline bucket
+	Inline   bool
+	Levels   []LevelStats // from the root
+	Keys     SizeDist     // without the dummy key
+	Vals     SizeDist     // before compression
+	// compression
+	Compressed  int    // values
+	StoredBytes uint64 // of all values in the leaves
+}
+
+func (s *TreeShape) Pages() int {
+	return s.Internal + s.Leaves
+}
+
+// the value bytes before compression over after, 1 without compression
+func (s *TreeShape) CompressionRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.Vals.Total) / float64(s.StoredBytes)
+}
+
+func treeShape(tree *BTree, inline bool) TreeShape {
+	shape := TreeShape{Inline: inline}
+	if tree.root == 0 {
+		return shape
+	}
+	var visit func(ptr uint64, depth int)
+	visit = func(ptr uint64, depth int) {
+		node := BNode(tree.get(ptr))
+		if len(shape.Levels) <= depth {
+			shape.Levels = append(shape.Levels, LevelStats{})
+		}
+		level := &shape.Levels[depth]
+		level.Pages++
+		level.Keys += int(node.nkeys())
+		level.Bytes += int(node.nbytes())
+		if node.btype() == BNODE_NODE {
+			shape.Internal++
+			for i := uint16(0); i < node.nkeys(); i++ {
+				visit(node.getPtr(i), depth+1)
+			}
+			return
+		}
+		shape.Leaves++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if key := node.getKey(i); len(key) > 0 {
+				shape.Keys.add(len(key))
+				shape.Vals.add(len(node.getVal(i)))
+				stored, codec := node.getStoredVal(i)
+				shape.StoredBytes += uint64(len(stored))
+				if codec != CODEC_NONE {
+					shape.Compressed++
+				}
+			}
+		}
+	}
+	visit(tree.root, 0)
+	shape.Height = len(shape.Levels)
+	if inline {
+		shape.Leaves = 0 // in the parent's page
+		shape.Levels[0].Pages = 0
+	}
+	return shape
+}
+
+type BucketShape struct {
+	Path []string
+	TreeShape
+}
+
+// The space usage of a DB. Values are stored in the leaves, so there are no
+// overflow pages; the pages of a DB are the meta page, the tree pages, the
+// free list nodes, the free pages, and the freed pages held by snapshots.
+type TreeStats struct {
+	Tree    TreeShape
+	Log     TreeShape // the change log
+	Catalog TreeShape // the top-level buckets
+	Buckets []BucketShape
+	// the free list
+	FreePages     int // FreeList.Total
+	FreeRuns      int // runs of contiguous free pages
+	FreeListPages int // the list nodes, including the held list
+	HeldPages     int // freed pages that snapshots may still read
+	// the file
+	FilePages uint64 // used by the DB, including the meta page
+	FileSize  uint64 // bytes of the page store, which can be larger
+}
+
+// all tree pages
+func (s *TreeStats) TreePages() int {
+	n := s.Tree.Pages() + s.Log.Pages() + s.Catalog.Pages()
+	for _, b := range s.Buckets {
+		n += b.Pages()
+	}
+	return n
+}
+
+// the bytes of the keys and values
+func (s *TreeStats) LiveBytes() uint64 {
+	n := s.Tree.Keys.Total + s.Tree.Vals.Total
+	for _, b := range s.Buckets {
+		n += b.Keys.Total + b.Vals.Total
+	}
+	return n
+}
+
+// analyze the trees of the last committed version
+func (db *KV) TreeStats() (stats TreeStats, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupted node: %v", r)
+		}
+	}()
+	stats.Tree = treeShape(&db.tree, false)
+	stats.Log = treeShape(&db.cdc.tree, false)
+	stats.Catalog = treeShape(&db.catalog, false)
+	err = forEachBucket(&db.catalog, func(path []string, tree *BTree) error {
+		inline := tree.root == ^uint64(0)
+		shape := BucketShape{Path: path, TreeShape: treeShape(tree, inline)}
+		stats.Buckets = append(stats.Buckets, shape)
+		return nil
+	})
+	if err != nil {
+		return TreeStats{}, err
+	}
+	for _, fl := range []*FreeList{&db.free, &db.held} {
+		for ptr := fl.head; ptr != 0; ptr = flnNext(fl.get(ptr)) {
+			stats.FreeListPages++
+		}
+	}
+	stats.FreePages = db.free.Total()
+	stats.FreeRuns = db.free.Runs()
+	stats.HeldPages = db.held.Total()
+	stats.FilePages = db.page.flushed
+	npages, err := db.store.Size()
+	if err != nil {
+		return TreeStats{}, err
+	}
+	stats.FileSize = npages * BTREE_PAGE_SIZE
+	return stats, nil
+}
@@ -0,0 +1,44 @@
+package btree
+
+import "bytes"
+
+// which keys an update can write
+type UpdateMode int
+
+const (
+	MODE_UPSERT      UpdateMode = iota // insert or replace
+	MODE_UPDATE_ONLY                   // only replace an existing key
+	MODE_INSERT_ONLY                   // only add a new key
+)
+
+type UpdateStatus int
+
+const (
+	STATUS_UNCHANGED UpdateStatus = iota // not allowed by the mode, or the same value
+	STATUS_ADDED
+	STATUS_UPDATED
+)
+
+// an insertion with a mode, and its result
+type UpdateReq struct {
+	// in
+	Key  []byte
+	Val  []byte
+	Mode UpdateMode
+	// out
+	Status UpdateStatus
+	Old    []byte // the value of an existing key, only valid until the next update
+}
+
+// should the key be written? `req.Old` is set if it is found.
+func (req *UpdateReq) apply(found bool) bool {
+	switch {
+	case found && req.Mode == MODE_INSERT_ONLY:
+		return false
+	case !found && req.Mode == MODE_UPDATE_ONLY:
+		return false
+	case found && bytes.Equal(req.Old, req.Val):
+		return false // nothing to write
+	}
+	return true
+}
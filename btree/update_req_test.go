@@ -0,0 +1,201 @@
+package btree
+
+import "testing"
+
+func TestUpdateModes(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	if err := db.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		mode   UpdateMode
+		key    string
+		val    string
+		status UpdateStatus
+		old    string // "" for none
+		after  string // "" for missing
+	}{
+		{MODE_UPSERT, "k", "v2", STATUS_UPDATED, "v1", "v2"},
+		{MODE_UPSERT, "k", "v2", STATUS_UNCHANGED, "v2", "v2"}, // the same value
+		{MODE_UPSERT, "a", "v1", STATUS_ADDED, "", "v1"},
+		{MODE_UPDATE_ONLY, "k", "v3", STATUS_UPDATED, "v2", "v3"},
+		{MODE_UPDATE_ONLY, "b", "v1", STATUS_UNCHANGED, "", ""},
+		{MODE_INSERT_ONLY, "k", "v4", STATUS_UNCHANGED, "v3", "v3"},
+		{MODE_INSERT_ONLY, "c", "v1", STATUS_ADDED, "", "v1"},
+	} {
+		req := &UpdateReq{Key: []byte(c.key), Val: []byte(c.val), Mode: c.mode}
+		if err := db.Update(req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Status != c.status || string(req.Old) != c.old || (req.Old == nil) != (c.old == "") {
+			t.Fatalf("mode %d %s=%s: status %d, old %q", c.mode, c.key, c.val, req.Status, req.Old)
+		}
+		got, ok := db.Get([]byte(c.key))
+		if string(got) != c.after || ok != (c.after != "") {
+			t.Fatalf("mode %d %s=%s: then %q %v", c.mode, c.key, c.val, got, ok)
+		}
+	}
+	// the old value is a copy
+	tx := db.Begin()
+	req := &UpdateReq{Key: []byte("k"), Val: []byte("v5")}
+	if err := tx.Update(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("k"), []byte("xx")); err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Old) != "v3" {
+		t.Fatalf("old %q", req.Old)
+	}
+	db.Abort(tx)
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	if err := db.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(key string, want string) {
+		t.Helper()
+		got, ok := db.Get([]byte(key))
+		if string(got) != want || ok != (want != "") {
+			t.Fatalf("%s: %q %v, want %q", key, got, ok, want)
+		}
+	}
+	type op struct {
+		name string
+		fn   func() (bool, error)
+		ok   bool
+	}
+	for _, c := range []op{
+		{"CAS on a missing key", func() (bool, error) {
+			return db.CompareAndSwap([]byte("missing"), nil, []byte("v"))
+		}, false},
+		{"CAS with a stale value", func() (bool, error) {
+			return db.CompareAndSwap([]byte("k"), []byte("v0"), []byte("v2"))
+		}, false},
+		{"SetIfAbsent on an existing key", func() (bool, error) {
+			return db.SetIfAbsent([]byte("k"), []byte("v2"))
+		}, false},
+		{"DeleteIfEquals with another value", func() (bool, error) {
+			return db.DeleteIfEquals([]byte("k"), []byte("v0"))
+		}, false},
+		{"DeleteIfEquals on a missing key", func() (bool, error) {
+			return db.DeleteIfEquals([]byte("missing"), nil)
+		}, false},
+	} {
+		if ok, err := c.fn(); err != nil || ok != c.ok {
+			t.Fatalf("%s: %v %v", c.name, ok, err)
+		}
+		check("k", "v1")
+		check("missing", "")
+	}
+	// the failed updates changed nothing
+	if seq := db.seq; seq != 1 {
+		t.Fatalf("seq %d", seq)
+	}
+	if ok, err := db.CompareAndSwap([]byte("k"), []byte("v1"), []byte("v2")); err != nil || !ok {
+		t.Fatalf("CAS: %v %v", ok, err)
+	}
+	check("k", "v2")
+	if ok, err := db.SetIfAbsent([]byte("new"), []byte("v1")); err != nil || !ok {
+		t.Fatalf("SetIfAbsent: %v %v", ok, err)
+	}
+	check("new", "v1")
+	if ok, err := db.DeleteIfEquals([]byte("k"), []byte("v2")); err != nil || !ok {
+		t.Fatalf("DeleteIfEquals: %v %v", ok, err)
+	}
+	check("k", "")
+	if seq := db.seq; seq != 4 {
+		t.Fatalf("seq %d", seq)
+	}
+}
+
+func TestUnchangedNotLogged(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	if err := db.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	set := nextChanges(t, sub)
+	if len(set.Changes) != 1 || string(set.Changes[0].Old) != "v1" || string(set.Changes[0].New) != "v2" {
+		t.Fatalf("changes: %+v", set.Changes)
+	}
+	if _, ok := sub.Next(); ok {
+		t.Fatal("the unchanged write is logged")
+	}
+}
+
+func TestBucketSetUnchanged(t *testing.T) {
+	db := openKV(t, &KV{Store: NewMemStore()})
+	small, err := db.CreateBucket("small", nil) // inline
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, err := db.CreateBucket("big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := big.CreateBucket("nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := []*Bucket{small, big, nested}
+	for _, b := range buckets {
+		if err := b.Set([]byte("k"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := big.Set([]byte("fill"), make([]byte, BUCKET_INLINE_MAX)); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := db.gen
+	for _, b := range buckets {
+		if err := b.Set([]byte("k"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.gen != gen {
+		t.Fatalf("committed %d times", db.gen-gen)
+	}
+	// the same in a transaction
+	tx := db.Begin()
+	for _, name := range [][]string{{"small"}, {"big"}, {"big", "nested"}} {
+		b, err := tx.Bucket(name[0])
+		for _, nested := range name[1:] {
+			if err == nil {
+				b, err = b.Bucket(nested)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set([]byte("k"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.Next(); ok {
+		t.Fatal("an unchanged bucket value is logged")
+	}
+	mustGet(t, nested, "k", "v1")
+	checkPages(t, db)
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
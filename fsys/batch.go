@@ -0,0 +1,55 @@
+package fsys
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Updates of multiple files in a single transaction.
+type Batch struct {
+	t *txn
+}
+
+// run `fn` in a transaction, which is committed if it returns nil
+func (fsys *FS) Update(fn func(b *Batch) error) error {
+	return fsys.update(func(t *txn) error {
+		return fn(&Batch{t: t})
+	})
+}
+
+func (b *Batch) MkdirAll(name string, perm fs.FileMode) error {
+	return pathError("mkdir", name, b.t.mkdirAll(name, perm))
+}
+
+// create or replace the content of a file
+func (b *Batch) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return pathError("write", name, b.t.writeFile(name, data, perm))
+}
+
+func (b *Batch) Chmod(name string, mode fs.FileMode) error {
+	return pathError("chmod", name, b.t.chmod(name, mode))
+}
+
+func (b *Batch) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	return pathError("chtimes", name, b.t.chtimes(name, mtime))
+}
+
+func (t *txn) writeFile(name string, data []byte, perm fs.FileMode) error {
+	node, err := t.lookup(name)
+	if err == fs.ErrNotExist {
+		node, err = t.link(name, perm.Perm())
+	}
+	if err != nil {
+		return err
+	}
+	if node.IsDir() {
+		return ErrIsDir
+	}
+	if err := t.truncate(&node, 0); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return t.writeAt(&node, data, 0)
+}
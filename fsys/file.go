@@ -0,0 +1,182 @@
+package fsys
+
+import (
+	"io"
+	"io/fs"
+	"time"
+)
+
+// A handle of an opened inode. It refers to the inode rather than the name,
+// so it follows renames. Each call is a transaction.
+type File struct {
+	fsys *FS
+	name string
+	ino  uint64
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Stat() (Inode, error) {
+	var node Inode
+	err := f.fsys.view(func(t *txn) (err error) {
+		node, err = t.getInode(f.ino)
+		return err
+	})
+	return node, pathError("stat", f.name, err)
+}
+
+// the entries of the directory in name order
+func (f *File) ReadDir() ([]DirEntry, error) {
+	var entries []DirEntry
+	err := f.fsys.view(func(t *txn) error {
+		dir, err := t.getInode(f.ino)
+		if err == nil {
+			entries, err = t.readDir(&dir)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pathError("readdir", f.name, err)
+	}
+	return entries, nil
+}
+
+// the file is read in a single transaction, holes are read as zeros
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("read", f.name, fs.ErrInvalid)
+	}
+	n := 0
+	err := f.fsys.view(func(t *txn) error {
+		node, err := t.getInode(f.ino)
+		if err == nil {
+			n, err = t.readAt(&node, p, off)
+		}
+		return err
+	})
+	if err == io.EOF {
+		return n, err
+	}
+	return n, pathError("read", f.name, err)
+}
+
+// the write is atomic, the file is extended if needed
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("write", f.name, fs.ErrInvalid)
+	}
+	err := f.fsys.update(func(t *txn) error {
+		node, err := t.getInode(f.ino)
+		if err == nil {
+			err = t.writeAt(&node, p, off)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, pathError("write", f.name, err)
+	}
+	return len(p), nil
+}
+
+// write at the end of the file, returns the offset of the write
+func (f *File) Append(p []byte) (int64, error) {
+	off := int64(0)
+	err := f.fsys.update(func(t *txn) error {
+		node, err := t.getInode(f.ino)
+		if err == nil {
+			off = node.Size
+			err = t.writeAt(&node, p, off)
+		}
+		return err
+	})
+	return off, pathError("write", f.name, err)
+}
+
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return pathError("truncate", f.name, fs.ErrInvalid)
+	}
+	return pathError("truncate", f.name, f.fsys.update(func(t *txn) error {
+		node, err := t.getInode(f.ino)
+		if err != nil {
+			return err
+		}
+		if node.IsDir() {
+			return ErrIsDir
+		}
+		return t.truncate(&node, size)
+	}))
+}
+
+func (t *txn) readAt(node *Inode, p []byte, off int64) (int, error) {
+	if node.IsDir() {
+		return 0, ErrIsDir
+	}
+	if off >= node.Size {
+		return 0, io.EOF
+	}
+	end := min(node.Size, off+int64(len(p)))
+	for pos := off; pos < end; {
+		idx, start := uint64(pos/BLOCK_SIZE), int(pos%BLOCK_SIZE)
+		data, err := t.getBlock(node.Ino, idx)
+		if err != nil {
+			return 0, err
+		}
+		chunk := p[pos-off : min(end-off, pos-off+BLOCK_SIZE-int64(start))]
+		copied := 0
+		if start < len(data) {
+			copied = copy(chunk, data[start:])
+		}
+		clear(chunk[copied:]) // a hole or past the stored data
+		pos += int64(len(chunk))
+	}
+	n := int(end - off)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (t *txn) writeAt(node *Inode, p []byte, off int64) error {
+	if node.IsDir() {
+		return ErrIsDir
+	}
+	if len(p) == 0 {
+		return nil // the size is unchanged
+	}
+	end := off + int64(len(p))
+	for pos := off; pos < end; {
+		idx, start := uint64(pos/BLOCK_SIZE), int(pos%BLOCK_SIZE)
+		data, err := t.getBlock(node.Ino, idx)
+		if err != nil {
+			return err
+		}
+		chunk := p[pos-off : min(end-off, pos-off+BLOCK_SIZE-int64(start))]
+		block := make([]byte, max(len(data), start+len(chunk)))
+		copy(block, data)
+		copy(block[start:], chunk)
+		if err := t.setBlock(node.Ino, idx, block); err != nil {
+			return err
+		}
+		pos += int64(len(chunk))
+	}
+	node.Size = max(node.Size, end)
+	node.Mtime = time.Now()
+	node.Ctime = node.Mtime
+	return t.setInode(node)
+}
+
+// change the file size, the extended part is a hole
+func (t *txn) truncate(node *Inode, size int64) error {
+	if size < node.Size {
+		if err := t.truncateBlocks(node.Ino, size); err != nil {
+			return err
+		}
+	}
+	node.Size = size
+	node.Mtime = time.Now()
+	node.Ctime = node.Mtime
+	return t.setInode(node)
+}
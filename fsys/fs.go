@@ -0,0 +1,434 @@
+package fsys
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"dbfs/btree"
+)
+
+var (
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+)
+
+// A file system in a KV. Names are slash-separated paths relative to the
+// root as in `io/fs`, and "." is the root. Each operation is a transaction.
+type FS struct {
+	db *btree.KV
+}
+
+// use the KV as a file system, the root directory is created if needed
+func New(db *btree.KV) (*FS, error) {
+	fsys := &FS{db: db}
+	err := fsys.update(func(t *txn) error {
+		_, err := t.getInode(ROOT_INO)
+		if err != fs.ErrNotExist {
+			return err
+		}
+		now := time.Now()
+		return t.setInode(&Inode{Ino: ROOT_INO, Mode: fs.ModeDir | 0o755, Mtime: now, Ctime: now})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// run `fn` in a transaction, which is committed if it returns nil
+func (fsys *FS) update(fn func(t *txn) error) error {
+	return fsys.db.WithBuckets(txnBuckets, true, func(b []*btree.Bucket) error {
+		return fn(&txn{inodes: b[0], dirents: b[1], blocks: b[2]})
+	})
+}
+
+// run `fn` in a transaction that is always rolled back
+func (fsys *FS) view(fn func(t *txn) error) error {
+	return fsys.db.WithBuckets(txnBuckets, false, func(b []*btree.Bucket) error {
+		return fn(&txn{inodes: b[0], dirents: b[1], blocks: b[2]})
+	})
+}
+
+func pathError(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve a path to its inode
+func (t *txn) lookup(name string) (Inode, error) {
+	if !fs.ValidPath(name) {
+		return Inode{}, fs.ErrInvalid
+	}
+	node, err := t.getInode(ROOT_INO)
+	if err != nil || name == "." {
+		return node, err
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !node.IsDir() {
+			return Inode{}, ErrNotDir
+		}
+		ino, ok, err := t.getDirent(node.Ino, elem)
+		if err != nil {
+			return Inode{}, err
+		}
+		if !ok {
+			return Inode{}, fs.ErrNotExist
+		}
+		if node, err = t.getInode(ino); err != nil {
+			return Inode{}, err
+		}
+	}
+	return node, nil
+}
+
+// resolve the parent directory of a path
+func (t *txn) lookupParent(name string) (Inode, string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return Inode{}, "", fs.ErrInvalid
+	}
+	dir, err := t.lookup(path.Dir(name))
+	if err != nil {
+		return Inode{}, "", err
+	}
+	if !dir.IsDir() {
+		return Inode{}, "", ErrNotDir
+	}
+	return dir, path.Base(name), nil
+}
+
+// a directory entry is added or removed
+func (t *txn) touchDir(dir *Inode) error {
+	dir.Mtime = time.Now()
+	dir.Ctime = dir.Mtime
+	return t.setInode(dir)
+}
+
+// add a new inode to a directory
+func (t *txn) link(name string, mode fs.FileMode) (Inode, error) {
+	dir, base, err := t.lookupParent(name)
+	if err != nil {
+		return Inode{}, err
+	}
+	if _, ok, err := t.getDirent(dir.Ino, base); err != nil {
+		return Inode{}, err
+	} else if ok {
+		return Inode{}, fs.ErrExist
+	}
+	node, err := t.newInode(mode)
+	if err != nil {
+		return Inode{}, err
+	}
+	if err := t.setDirent(dir.Ino, base, node.Ino); err != nil {
+		return Inode{}, err
+	}
+	return node, t.touchDir(&dir)
+}
+
+// remove a directory entry and free the inode
+func (t *txn) unlink(dir *Inode, base string, node *Inode) error {
+	if node.IsDir() {
+		empty, err := t.dirEmpty(node.Ino)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrNotEmpty
+		}
+	}
+	if err := t.delDirent(dir.Ino, base); err != nil {
+		return err
+	}
+	if err := t.delInode(node.Ino); err != nil {
+		return err
+	}
+	return t.touchDir(dir)
+}
+
+func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
+	return pathError("mkdir", name, fsys.update(func(t *txn) error {
+		_, err := t.link(name, fs.ModeDir|perm.Perm())
+		return err
+	}))
+}
+
+// create or truncate a file
+func (fsys *FS) Create(name string) (*File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+// open a file or a directory
+func (fsys *FS) Open(name string) (*File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// open with the flags of os.OpenFile
+func (fsys *FS) OpenFile(name string, flag int, perm fs.FileMode) (*File, error) {
+	var node Inode
+	run := fsys.update
+	if flag&(os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_RDWR) == 0 {
+		run = fsys.view // also on a read-only replica
+	}
+	err := run(func(t *txn) (err error) {
+		node, err = t.lookup(name)
+		switch {
+		case err == fs.ErrNotExist && flag&os.O_CREATE != 0:
+			node, err = t.link(name, perm.Perm())
+			return err
+		case err != nil:
+			return err
+		case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return fs.ErrExist
+		case node.IsDir() && flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+			return ErrIsDir
+		case flag&os.O_TRUNC != 0 && node.Size > 0:
+			return t.truncate(&node, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &File{fsys: fsys, name: name, ino: node.Ino}, nil
+}
+
+// read a whole file in a single transaction
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	var data []byte
+	err := fsys.view(func(t *txn) error {
+		node, err := t.lookup(name)
+		if err != nil {
+			return err
+		}
+		data = make([]byte, node.Size)
+		_, err = t.readAt(&node, data, 0)
+		if err == io.EOF {
+			err = nil // empty
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	return data, nil
+}
+
+func (fsys *FS) Stat(name string) (Inode, error) {
+	var node Inode
+	err := fsys.view(func(t *txn) (err error) {
+		node, err = t.lookup(name)
+		return err
+	})
+	return node, pathError("stat", name, err)
+}
+
+// remove a file or an empty directory
+func (fsys *FS) Unlink(name string) error {
+	return pathError("unlink", name, fsys.update(func(t *txn) error {
+		dir, base, err := t.lookupParent(name)
+		if err != nil {
+			return err
+		}
+		node, err := t.lookup(name)
+		if err != nil {
+			return err
+		}
+		return t.unlink(&dir, base, &node)
+	}))
+}
+
+// remove a path and everything it contains
+func (fsys *FS) RemoveAll(name string) error {
+	return pathError("removeall", name, fsys.update(func(t *txn) error {
+		dir, base, err := t.lookupParent(name)
+		if err != nil {
+			return err
+		}
+		node, err := t.lookup(name)
+		if err == fs.ErrNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return t.removeAll(&dir, base, &node)
+	}))
+}
+
+func (t *txn) removeAll(dir *Inode, base string, node *Inode) error {
+	if node.IsDir() {
+		entries, err := t.readDir(node)
+		if err != nil {
+			return err
+		}
+		for _, ent := range entries {
+			if err := t.removeAll(node, ent.Name, &ent.Inode); err != nil {
+				return err
+			}
+		}
+	}
+	return t.unlink(dir, base, node)
+}
+
+// create a directory and its missing parents
+func (fsys *FS) MkdirAll(name string, perm fs.FileMode) error {
+	return pathError("mkdir", name, fsys.update(func(t *txn) error {
+		return t.mkdirAll(name, perm)
+	}))
+}
+
+func (t *txn) mkdirAll(name string, perm fs.FileMode) error {
+	node, err := t.lookup(name)
+	if err == nil && !node.IsDir() {
+		return ErrNotDir
+	}
+	if err != fs.ErrNotExist {
+		return err
+	}
+	if parent := path.Dir(name); parent != "." {
+		if err := t.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	_, err = t.link(name, fs.ModeDir|perm.Perm())
+	return err
+}
+
+// change the permission bits
+func (fsys *FS) Chmod(name string, mode fs.FileMode) error {
+	return pathError("chmod", name, fsys.update(func(t *txn) error {
+		return t.chmod(name, mode)
+	}))
+}
+
+func (t *txn) chmod(name string, mode fs.FileMode) error {
+	node, err := t.lookup(name)
+	if err != nil {
+		return err
+	}
+	node.Mode = node.Mode&^fs.ModePerm | mode.Perm()
+	node.Ctime = time.Now()
+	return t.setInode(&node)
+}
+
+// set the modification time, the access time is not stored
+func (fsys *FS) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	return pathError("chtimes", name, fsys.update(func(t *txn) error {
+		return t.chtimes(name, mtime)
+	}))
+}
+
+func (t *txn) chtimes(name string, mtime time.Time) error {
+	node, err := t.lookup(name)
+	if err != nil {
+		return err
+	}
+	node.Mtime = mtime
+	node.Ctime = time.Now()
+	return t.setInode(&node)
+}
+
+// move a file or a directory. an existing target is replaced if it's a
+// file, or if it's an empty directory and the source is a directory.
+func (fsys *FS) Rename(oldname string, newname string) error {
+	err := fsys.update(func(t *txn) error {
+		if strings.HasPrefix(newname, oldname+"/") {
+			return fs.ErrInvalid // into itself
+		}
+		odir, obase, err := t.lookupParent(oldname)
+		if err != nil {
+			return err
+		}
+		node, err := t.lookup(oldname)
+		if err != nil {
+			return err
+		}
+		ndir, nbase, err := t.lookupParent(newname)
+		if err != nil {
+			return err
+		}
+		// replace the target
+		target, err := t.lookup(newname)
+		switch {
+		case err == fs.ErrNotExist:
+		case err != nil:
+			return err
+		case target.Ino == node.Ino:
+			return nil // same file
+		case target.IsDir() && !node.IsDir():
+			return ErrIsDir
+		case !target.IsDir() && node.IsDir():
+			return ErrNotDir
+		default:
+			if err := t.unlink(&ndir, nbase, &target); err != nil {
+				return err
+			}
+		}
+		// move the entry
+		if err := t.delDirent(odir.Ino, obase); err != nil {
+			return err
+		}
+		if err := t.touchDir(&odir); err != nil {
+			return err
+		}
+		if ndir, err = t.getInode(ndir.Ino); err != nil {
+			return err // reload in case it's the same directory
+		}
+		if err := t.setDirent(ndir.Ino, nbase, node.Ino); err != nil {
+			return err
+		}
+		return t.touchDir(&ndir)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname + " " + newname, Err: err}
+	}
+	return nil
+}
+
+type DirEntry struct {
+	Name string
+	Inode
+}
+
+// the entries of a directory in name order
+func (fsys *FS) ReadDir(name string) ([]DirEntry, error) {
+	var entries []DirEntry
+	err := fsys.view(func(t *txn) error {
+		dir, err := t.lookup(name)
+		if err == nil {
+			entries, err = t.readDir(&dir)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	return entries, nil
+}
+
+func (t *txn) readDir(dir *Inode) ([]DirEntry, error) {
+	if !dir.IsDir() {
+		return nil, ErrNotDir
+	}
+	entries := []DirEntry{}
+	inos := []uint64{}
+	err := t.scanDir(dir.Ino, func(base string, ino uint64) bool {
+		entries = append(entries, DirEntry{Name: base})
+		inos = append(inos, ino)
+		return true
+	})
+	for i := range entries {
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Inode, err = t.getInode(inos[i])
+	}
+	return entries, err
+}
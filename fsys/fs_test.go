@@ -0,0 +1,312 @@
+package fsys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"dbfs/btree"
+)
+
+func newFS(t *testing.T) *FS {
+	t.Helper()
+	db := &btree.KV{Store: btree.NewMemStore()}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	fsys, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// the stored length of each block of a file
+func fileBlocks(t *testing.T, fsys *FS, name string) map[uint64]int {
+	t.Helper()
+	blocks := map[uint64]int{}
+	err := fsys.view(func(t *txn) error {
+		node, err := t.lookup(name)
+		if err != nil {
+			return err
+		}
+		return t.blocks.Scan(inodeKey(node.Ino), func(key []byte, val []byte) bool {
+			if binary.BigEndian.Uint64(key) != node.Ino {
+				return false
+			}
+			blocks[binary.BigEndian.Uint64(key[8:])] = len(val)
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func mustWrite(t *testing.T, f *File, p []byte, off int64) {
+	t.Helper()
+	if n, err := f.WriteAt(p, off); err != nil || n != len(p) {
+		t.Fatalf("write %d at %d: %d %v", len(p), off, n, err)
+	}
+}
+
+func mustRead(t *testing.T, fsys *FS, name string, want []byte) {
+	t.Helper()
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("%s: got %d bytes, want %d", name, len(data), len(want))
+	}
+}
+
+func TestFileHoles(t *testing.T) {
+	fsys := newFS(t)
+	f, err := fsys.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a write in the middle of block 2 leaves a hole before it
+	want := make([]byte, 2*BLOCK_SIZE+1100)
+	data := bytes.Repeat([]byte("x"), 100)
+	copy(want[2*BLOCK_SIZE+1000:], data)
+	mustWrite(t, f, data, 2*BLOCK_SIZE+1000)
+	mustRead(t, fsys, "f", want)
+	if got := fileBlocks(t, fsys, "f"); len(got) != 1 || got[2] != 1100 {
+		t.Fatalf("blocks %v", got)
+	}
+	// a write across blocks 0 and 1, not aligned
+	data = bytes.Repeat([]byte("y"), 30)
+	copy(want[BLOCK_SIZE-10:], data)
+	mustWrite(t, f, data, BLOCK_SIZE-10)
+	mustRead(t, fsys, "f", want)
+	if got := fileBlocks(t, fsys, "f"); len(got) != 3 || got[0] != BLOCK_SIZE || got[1] != 20 {
+		t.Fatalf("blocks %v", got)
+	}
+	// partial reads of the hole and the data
+	for _, c := range []struct{ off, n int }{
+		{0, 10}, {BLOCK_SIZE - 15, 30}, {BLOCK_SIZE + 10, 50}, {BLOCK_SIZE + 15, BLOCK_SIZE},
+		{2*BLOCK_SIZE + 990, 20},
+	} {
+		p := bytes.Repeat([]byte{0xff}, c.n)
+		if n, err := f.ReadAt(p, int64(c.off)); err != nil || n != c.n {
+			t.Fatalf("read %d at %d: %d %v", c.n, c.off, n, err)
+		}
+		if !bytes.Equal(p, want[c.off:c.off+c.n]) {
+			t.Fatalf("read %d at %d: %q", c.n, c.off, p)
+		}
+	}
+	// a short read at the end
+	p := make([]byte, 200)
+	if n, err := f.ReadAt(p, int64(len(want)-50)); err != io.EOF || n != 50 {
+		t.Fatalf("short read: %d %v", n, err)
+	}
+	if n, err := f.ReadAt(p, int64(len(want))); err != io.EOF || n != 0 {
+		t.Fatalf("read at the end: %d %v", n, err)
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	fsys := newFS(t)
+	f, err := fsys.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, f, []byte("abc"), 0)
+	mustWrite(t, f, nil, 2*BLOCK_SIZE)
+	if node, err := f.Stat(); err != nil || node.Size != 3 {
+		t.Fatalf("size %d %v", node.Size, err)
+	}
+	if got := fileBlocks(t, fsys, "f"); len(got) != 1 {
+		t.Fatalf("blocks %v", got)
+	}
+}
+
+func TestOpenReplica(t *testing.T) {
+	primary := newFS(t)
+	// a pinned snapshot keeps the freed pages in the held list
+	snap := primary.db.Snapshot()
+	defer snap.Release()
+	data := bytes.Repeat([]byte("x"), 3*BLOCK_SIZE)
+	for i := 0; i < 2; i++ {
+		f, err := primary.Create("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustWrite(t, f, data, 0)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go primary.db.ServeReplicas(ln)
+	db := &btree.KV{Store: btree.NewMemStore()}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go db.Follow(conn)
+	replica := &FS{db: db}
+	deadline := time.Now().Add(10 * time.Second)
+	for got, _ := replica.ReadFile("f"); !bytes.Equal(got, data); got, _ = replica.ReadFile("f") {
+		if time.Now().After(deadline) {
+			t.Fatal("the replica has no file")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// reads work on the replica, writes don't
+	f, err := replica.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if n, err := f.ReadAt(p, 0); err != nil || n != len(p) {
+		t.Fatalf("read: %d %v", n, err)
+	}
+	if _, err := replica.OpenFile("f", os.O_RDWR|os.O_TRUNC, 0); !errors.Is(err, btree.ErrReadOnly) {
+		t.Fatalf("truncate on a replica: %v", err)
+	}
+}
+
+func TestFileTruncate(t *testing.T) {
+	fsys := newFS(t)
+	f, err := fsys.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("abcdefg"), (3*BLOCK_SIZE+500)/7)
+	mustWrite(t, f, data, 0)
+	if got := fileBlocks(t, fsys, "f"); len(got) != 4 {
+		t.Fatalf("blocks %v", got)
+	}
+	// the blocks past the size are removed and the last one is trimmed
+	if err := f.Truncate(BLOCK_SIZE + 100); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileBlocks(t, fsys, "f"); len(got) != 2 || got[1] != 100 {
+		t.Fatalf("blocks %v", got)
+	}
+	mustRead(t, fsys, "f", data[:BLOCK_SIZE+100])
+	// extending makes a hole, the old data doesn't come back
+	if err := f.Truncate(int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, len(data))
+	copy(want, data[:BLOCK_SIZE+100])
+	mustRead(t, fsys, "f", want)
+	if got := fileBlocks(t, fsys, "f"); len(got) != 2 {
+		t.Fatalf("blocks %v", got)
+	}
+	// a block boundary
+	if err := f.Truncate(BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileBlocks(t, fsys, "f"); len(got) != 1 || got[0] != BLOCK_SIZE {
+		t.Fatalf("blocks %v", got)
+	}
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileBlocks(t, fsys, "f"); len(got) != 0 {
+		t.Fatalf("blocks %v", got)
+	}
+	// the blocks of an unlinked file are freed
+	mustWrite(t, f, data, 0)
+	ino := f.ino
+	if err := fsys.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	left := false
+	err = fsys.view(func(t *txn) error {
+		return t.blocks.Scan(inodeKey(ino), func(key []byte, _ []byte) bool {
+			left = binary.BigEndian.Uint64(key) == ino
+			return false
+		})
+	})
+	if err != nil || left {
+		t.Fatalf("blocks left after unlink: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	fsys := newFS(t)
+	for _, dir := range []string{"a/b/c", "empty", "full/sub"} {
+		if err := fsys.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"f1", "f2", "a/b/f3"} {
+		f, err := fsys.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustWrite(t, f, []byte(name), 0)
+	}
+	// over a file, which is replaced
+	if err := fsys.Rename("f1", "f2"); err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, fsys, "f2", []byte("f1"))
+	if _, err := fsys.Stat("f1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("old name: %v", err)
+	}
+	// a file over a directory and a directory over a file
+	if err := fsys.Rename("f2", "empty"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("file over dir: %v", err)
+	}
+	if err := fsys.Rename("empty", "f2"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("dir over file: %v", err)
+	}
+	// over a non-empty directory
+	if err := fsys.Rename("a", "full"); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("over a non-empty dir: %v", err)
+	}
+	mustRead(t, fsys, "a/b/f3", []byte("a/b/f3"))
+	// into its own subtree
+	for _, name := range []string{"a/b/c/a", "a/x"} {
+		if err := fsys.Rename("a", name); !errors.Is(err, fs.ErrInvalid) {
+			t.Fatalf("into itself %s: %v", name, err)
+		}
+	}
+	// over an empty directory, the subtree moves with it
+	if err := fsys.Rename("a", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, fsys, "empty/b/f3", []byte("a/b/f3"))
+	if _, err := fsys.Stat("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("old name: %v", err)
+	}
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ent := range entries {
+		names = append(names, ent.Name)
+	}
+	if len(names) != 3 || names[0] != "empty" || names[1] != "f2" || names[2] != "full" {
+		t.Fatalf("root %v", names)
+	}
+	// within the same directory
+	if err := fsys.Rename("empty/b/f3", "empty/b/f4"); err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, fsys, "empty/b/f4", []byte("a/b/f3"))
+}
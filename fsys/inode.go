@@ -0,0 +1,204 @@
+package fsys
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"time"
+
+	"dbfs/btree"
+)
+
+// The file system is stored in 3 buckets of the KV:
+//   - inodes:  ino => | mode 4B | size 8B | mtime 8B | ctime 8B |
+//   - dirents: | parent ino 8B | name | => child ino 8B
+//   - blocks:  | ino 8B | block index 8B | => data
+//
+// The keys are big-endian, so the entries of a directory and the blocks of
+// a file are contiguous and ordered. Inode 0 is not used, its value is the
+// next inode number to allocate.
+const (
+	BUCKET_INODES  = "inodes"
+	BUCKET_DIRENTS = "dirents"
+	BUCKET_BLOCKS  = "blocks"
+)
+
+// the buckets of a txn in order
+var txnBuckets = []string{BUCKET_INODES, BUCKET_DIRENTS, BUCKET_BLOCKS}
+
+const (
+	ROOT_INO   = 1
+	INODE_SIZE = 28
+	BLOCK_SIZE = 2000 // 2 blocks fit in a page
+)
+
+type Inode struct {
+	Ino   uint64
+	Mode  fs.FileMode
+	Size  int64
+	Mtime time.Time // last modification of the content
+	Ctime time.Time // last change of the content or the inode
+}
+
+func (node *Inode) IsDir() bool {
+	return node.Mode.IsDir()
+}
+
+func encodeInode(node *Inode) []byte {
+	var data [INODE_SIZE]byte
+	binary.LittleEndian.PutUint32(data[0:], uint32(node.Mode))
+	binary.LittleEndian.PutUint64(data[4:], uint64(node.Size))
+	binary.LittleEndian.PutUint64(data[12:], uint64(node.Mtime.UnixNano()))
+	binary.LittleEndian.PutUint64(data[20:], uint64(node.Ctime.UnixNano()))
+	return data[:]
+}
+
+func decodeInode(ino uint64, data []byte) Inode {
+	return Inode{
+		Ino:   ino,
+		Mode:  fs.FileMode(binary.LittleEndian.Uint32(data[0:])),
+		Size:  int64(binary.LittleEndian.Uint64(data[4:])),
+		Mtime: time.Unix(0, int64(binary.LittleEndian.Uint64(data[12:]))),
+		Ctime: time.Unix(0, int64(binary.LittleEndian.Uint64(data[20:]))),
+	}
+}
+
+func inodeKey(ino uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, ino)
+}
+
+func direntKey(parent uint64, name string) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, parent), name...)
+}
+
+func blockKey(ino uint64, idx uint64) []byte {
+	return binary.BigEndian.AppendUint64(inodeKey(ino), idx)
+}
+
+// the buckets in a KV transaction
+type txn struct {
+	inodes  *btree.Bucket
+	dirents *btree.Bucket
+	blocks  *btree.Bucket
+}
+
+func (t *txn) getInode(ino uint64) (Inode, error) {
+	val, ok, err := t.inodes.Get(inodeKey(ino))
+	if err != nil {
+		return Inode{}, err
+	}
+	if !ok {
+		return Inode{}, fs.ErrNotExist
+	}
+	return decodeInode(ino, val), nil
+}
+
+func (t *txn) setInode(node *Inode) error {
+	return t.inodes.Set(inodeKey(node.Ino), encodeInode(node))
+}
+
+// allocate an inode number
+func (t *txn) newInode(mode fs.FileMode) (Inode, error) {
+	ino := uint64(ROOT_INO + 1)
+	val, ok, err := t.inodes.Get(inodeKey(0))
+	if err != nil {
+		return Inode{}, err
+	}
+	if ok {
+		ino = binary.LittleEndian.Uint64(val)
+	}
+	next := binary.LittleEndian.AppendUint64(nil, ino+1)
+	if err := t.inodes.Set(inodeKey(0), next); err != nil {
+		return Inode{}, err
+	}
+	now := time.Now()
+	node := Inode{Ino: ino, Mode: mode, Mtime: now, Ctime: now}
+	return node, t.setInode(&node)
+}
+
+// remove an inode and its data
+func (t *txn) delInode(ino uint64) error {
+	if err := t.truncateBlocks(ino, 0); err != nil {
+		return err
+	}
+	_, err := t.inodes.Del(inodeKey(ino))
+	return err
+}
+
+// the child inode of a directory entry
+func (t *txn) getDirent(parent uint64, name string) (uint64, bool, error) {
+	val, ok, err := t.dirents.Get(direntKey(parent, name))
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint64(val), true, nil
+}
+
+func (t *txn) setDirent(parent uint64, name string, ino uint64) error {
+	return t.dirents.Set(direntKey(parent, name), inodeKey(ino))
+}
+
+func (t *txn) delDirent(parent uint64, name string) error {
+	_, err := t.dirents.Del(direntKey(parent, name))
+	return err
+}
+
+// call `fn` with each entry of a directory in name order
+func (t *txn) scanDir(ino uint64, fn func(name string, child uint64) bool) error {
+	prefix := inodeKey(ino)
+	return t.dirents.Scan(prefix, func(key []byte, val []byte) bool {
+		if len(key) < 8 || binary.BigEndian.Uint64(key) != ino {
+			return false
+		}
+		return fn(string(key[8:]), binary.BigEndian.Uint64(val))
+	})
+}
+
+func (t *txn) dirEmpty(ino uint64) (bool, error) {
+	empty := true
+	err := t.scanDir(ino, func(string, uint64) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// a data block, nil for holes
+func (t *txn) getBlock(ino uint64, idx uint64) ([]byte, error) {
+	val, _, err := t.blocks.Get(blockKey(ino, idx))
+	return val, err
+}
+
+func (t *txn) setBlock(ino uint64, idx uint64, data []byte) error {
+	return t.blocks.Set(blockKey(ino, idx), data)
+}
+
+// remove the data past `size`. blocks never contain data past the file size.
+func (t *txn) truncateBlocks(ino uint64, size int64) error {
+	first := uint64((size + BLOCK_SIZE - 1) / BLOCK_SIZE) // the 1st block to remove
+	keys := [][]byte{}
+	err := t.blocks.Scan(blockKey(ino, first), func(key []byte, _ []byte) bool {
+		if binary.BigEndian.Uint64(key) != ino {
+			return false
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := t.blocks.Del(key); err != nil {
+			return err
+		}
+	}
+	// the partial block at the end
+	if size%BLOCK_SIZE == 0 {
+		return nil
+	}
+	idx, end := uint64(size/BLOCK_SIZE), int(size%BLOCK_SIZE)
+	data, err := t.getBlock(ino, idx)
+	if err != nil || len(data) <= end {
+		return err
+	}
+	return t.setBlock(ino, idx, append([]byte(nil), data[:end]...))
+}
@@ -0,0 +1,263 @@
+package fsys
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// A writable file system with the operations of package os, in the style of
+// afero. The reads are the same as io/fs, so the file system works with
+// fs.WalkDir, http.FS and template.ParseFS.
+type WritableFS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+	OpenFile(name string, flag int, perm fs.FileMode) (WritableFile, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname string, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+type WritableFile interface {
+	fs.ReadDirFile
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// the file system through the standard interfaces
+func (fsys *FS) Std() *StdFS {
+	return &StdFS{fsys: fsys}
+}
+
+type StdFS struct {
+	fsys *FS
+}
+
+var _ WritableFS = (*StdFS)(nil)
+
+func (s *StdFS) Open(name string) (fs.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *StdFS) OpenFile(name string, flag int, perm fs.FileMode) (WritableFile, error) {
+	f, err := s.fsys.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &stdFile{file: f, flag: flag}, nil
+}
+
+func (s *StdFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := s.fsys.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), node: node}, nil
+}
+
+func (s *StdFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := s.fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return dirEntries(entries), nil
+}
+
+func (s *StdFS) ReadFile(name string) ([]byte, error) {
+	return s.fsys.ReadFile(name)
+}
+
+func (s *StdFS) Mkdir(name string, perm fs.FileMode) error {
+	return s.fsys.Mkdir(name, perm)
+}
+
+func (s *StdFS) MkdirAll(name string, perm fs.FileMode) error {
+	return s.fsys.MkdirAll(name, perm)
+}
+
+func (s *StdFS) Remove(name string) error {
+	return s.fsys.Unlink(name)
+}
+
+func (s *StdFS) RemoveAll(name string) error {
+	return s.fsys.RemoveAll(name)
+}
+
+func (s *StdFS) Rename(oldname string, newname string) error {
+	return s.fsys.Rename(oldname, newname)
+}
+
+func (s *StdFS) Chmod(name string, mode fs.FileMode) error {
+	return s.fsys.Chmod(name, mode)
+}
+
+func (s *StdFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return s.fsys.Chtimes(name, atime, mtime)
+}
+
+// fs.FileInfo and fs.DirEntry
+type fileInfo struct {
+	name string
+	node Inode
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return fi.node.Size }
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.node.Mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.node.Mtime }
+func (fi *fileInfo) IsDir() bool                { return fi.node.IsDir() }
+func (fi *fileInfo) Sys() any                   { return &fi.node }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.node.Mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+func (fi *fileInfo) String() string             { return fs.FormatFileInfo(fi) }
+
+func dirEntries(entries []DirEntry) []fs.DirEntry {
+	out := make([]fs.DirEntry, len(entries))
+	for i, ent := range entries {
+		out[i] = &fileInfo{name: ent.Name, node: ent.Inode}
+	}
+	return out
+}
+
+// an opened file with an offset
+type stdFile struct {
+	file   *File
+	flag   int
+	offset int64
+	dir    []fs.DirEntry // the unread entries after the 1st ReadDir
+	closed bool
+}
+
+// `mode` is the access mode needed by the operation, -1 for none
+func (f *stdFile) check(op string, mode int) error {
+	if f.closed {
+		return pathError(op, f.file.name, fs.ErrClosed)
+	}
+	access := f.flag & (os.O_WRONLY | os.O_RDWR)
+	if mode >= 0 && access != mode && access != os.O_RDWR {
+		return pathError(op, f.file.name, fs.ErrPermission)
+	}
+	return nil
+}
+
+func (f *stdFile) Stat() (fs.FileInfo, error) {
+	if err := f.check("stat", -1); err != nil {
+		return nil, err
+	}
+	node, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(f.file.name), node: node}, nil
+}
+
+func (f *stdFile) Read(p []byte) (int, error) {
+	if err := f.check("read", os.O_RDONLY); err != nil {
+		return 0, err
+	}
+	n, err := f.file.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *stdFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", os.O_RDONLY); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *stdFile) Write(p []byte) (int, error) {
+	if err := f.check("write", os.O_WRONLY); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		off, err := f.file.Append(p)
+		if err != nil {
+			return 0, err
+		}
+		f.offset = off + int64(len(p))
+		return len(p), nil
+	}
+	n, err := f.file.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *stdFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", os.O_WRONLY); err != nil {
+		return 0, err
+	}
+	return f.file.WriteAt(p, off)
+}
+
+func (f *stdFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", -1); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		node, err := f.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += node.Size
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.file.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *stdFile) Truncate(size int64) error {
+	if err := f.check("truncate", os.O_WRONLY); err != nil {
+		return err
+	}
+	return f.file.Truncate(size)
+}
+
+// the entries are loaded on the 1st call, n <= 0 reads all remaining entries
+func (f *stdFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if err := f.check("readdir", -1); err != nil {
+		return nil, err
+	}
+	if f.dir == nil {
+		entries, err := f.file.ReadDir()
+		if err != nil {
+			return nil, err
+		}
+		f.dir = dirEntries(entries)
+	}
+	if n <= 0 {
+		out := f.dir
+		f.dir = f.dir[len(f.dir):]
+		return out, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	out := f.dir[:min(n, len(f.dir))]
+	f.dir = f.dir[len(out):]
+	return out, nil
+}
+
+func (f *stdFile) Close() error {
+	if err := f.check("close", -1); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
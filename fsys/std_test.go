@@ -0,0 +1,71 @@
+package fsys
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestStdFS(t *testing.T) {
+	std := newFS(t).Std()
+	files := map[string][]byte{
+		"empty":          nil,
+		"hello.txt":      []byte("hello, world\n"),
+		"a/big":          bytes.Repeat([]byte("0123456789"), BLOCK_SIZE),
+		"a/b/c/deep.txt": []byte("deep"),
+		"a/b/other":      []byte("other"),
+	}
+	for _, dir := range []string{"a/b/c", "a/empty"} {
+		if err := std.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		f, err := std.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := std.Chtimes("hello.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(std, "empty", "hello.txt", "a/big", "a/b/c/deep.txt", "a/b/other", "a/empty"); err != nil {
+		t.Fatal(err)
+	}
+	// the writes through the offset, and the access mode
+	f, err := std.OpenFile("hello.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Fatal("write to a read-only file")
+	}
+	f.Close()
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after close")
+	}
+	f, err = std.OpenFile("hello.txt", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bye\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || string(rest) != "world\nbye\n" {
+		t.Fatalf("read after append: %q %v", rest, err)
+	}
+}
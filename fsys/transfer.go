@@ -0,0 +1,306 @@
+package fsys
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Small files are imported in batches up to these limits per transaction.
+// Larger files are written in chunks, one transaction per chunk.
+const (
+	IMPORT_BATCH_BYTES = 4 << 20
+	IMPORT_BATCH_FILES = 1000
+)
+
+var ErrVerify = errors.New("content hash mismatch")
+
+// counters of an import or export
+type TransferStats struct {
+	Dirs    int
+	Files   int
+	Bytes   int64
+	Skipped []string // not a regular file or a directory
+}
+
+type fileMeta struct {
+	name  string
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+// the pending updates of an import
+type importBatch struct {
+	fsys  *FS
+	files []fileMeta
+	data  [][]byte // nil for directories
+	size  int
+}
+
+func (b *importBatch) flush() error {
+	if len(b.files) == 0 {
+		return nil
+	}
+	err := b.fsys.Update(func(batch *Batch) error {
+		for i, meta := range b.files {
+			err := error(nil)
+			if meta.mode.IsDir() {
+				err = batch.MkdirAll(meta.name, meta.mode)
+			} else {
+				err = batch.WriteFile(meta.name, b.data[i], meta.mode)
+			}
+			if err == nil {
+				err = batch.Chmod(meta.name, meta.mode)
+			}
+			if err == nil && !meta.mode.IsDir() {
+				err = batch.Chtimes(meta.name, meta.mtime, meta.mtime)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	b.files, b.data, b.size = b.files[:0], b.data[:0], 0
+	return err
+}
+
+func (b *importBatch) add(meta fileMeta, data []byte) error {
+	b.files = append(b.files, meta)
+	b.data = append(b.data, data)
+	b.size += len(data)
+	if b.size >= IMPORT_BATCH_BYTES || len(b.files) >= IMPORT_BATCH_FILES {
+		return b.flush()
+	}
+	return nil
+}
+
+// write a large file in chunks
+func (fsys *FS) importLarge(meta fileMeta, src string) error {
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	f, err := fsys.OpenFile(meta.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, meta.mode)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, IMPORT_BATCH_BYTES)
+	for off := int64(0); ; {
+		n, err := io.ReadFull(fp, buf)
+		if n > 0 {
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fsys.Update(func(batch *Batch) error {
+		if err := batch.Chmod(meta.name, meta.mode); err != nil {
+			return err
+		}
+		return batch.Chtimes(meta.name, meta.mtime, meta.mtime)
+	})
+}
+
+// copy a host directory tree into the root, then verify the content hashes
+func (fsys *FS) Import(dir string) (TransferStats, error) {
+	stats := TransferStats{}
+	batch := &importBatch{fsys: fsys}
+	hashes := map[string][]byte{}
+	dirs := []fileMeta{} // mtimes are set after the content
+	err := filepath.WalkDir(dir, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, src)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		meta := fileMeta{name: filepath.ToSlash(rel), mode: info.Mode(), mtime: info.ModTime()}
+		switch {
+		case d.IsDir():
+			stats.Dirs++
+			dirs = append(dirs, meta)
+			return batch.add(meta, nil)
+		case !info.Mode().IsRegular():
+			stats.Skipped = append(stats.Skipped, meta.name)
+			return nil
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		if info.Size() >= IMPORT_BATCH_BYTES {
+			if err := batch.flush(); err != nil {
+				return err
+			}
+			hashes[meta.name], err = hashHostFile(src)
+			if err != nil {
+				return err
+			}
+			return fsys.importLarge(meta, src)
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hashes[meta.name] = sum[:]
+		return batch.add(meta, data)
+	})
+	if err == nil {
+		err = batch.flush()
+	}
+	if err == nil {
+		err = fsys.setDirTimes(dirs)
+	}
+	if err != nil {
+		return stats, err
+	}
+	return stats, verifyHashes(hashes, fsys.hashFile)
+}
+
+// compare the content hashes after a transfer
+func verifyHashes(hashes map[string][]byte, hash func(name string) ([]byte, error)) error {
+	for name, want := range hashes {
+		got, err := hash(name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("%s: %w", name, ErrVerify)
+		}
+	}
+	return nil
+}
+
+// adding the children changed the mtimes of the directories
+func (fsys *FS) setDirTimes(dirs []fileMeta) error {
+	for i := 0; i < len(dirs); i += IMPORT_BATCH_FILES {
+		chunk := dirs[i:min(len(dirs), i+IMPORT_BATCH_FILES)]
+		err := fsys.Update(func(batch *Batch) error {
+			for _, meta := range chunk {
+				if err := batch.Chtimes(meta.name, meta.mtime, meta.mtime); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashHostFile(name string) ([]byte, error) {
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (fsys *FS) hashFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// recreate the tree in a host directory, then verify the content hashes
+func (fsys *FS) Export(dir string) (TransferStats, error) {
+	stats := TransferStats{}
+	hashes := map[string][]byte{} // by the host path
+	dirs := []fileMeta{}
+	err := fs.WalkDir(fsys.Std(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		meta := fileMeta{name: name, mode: info.Mode(), mtime: info.ModTime()}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if d.IsDir() {
+			stats.Dirs++
+			dirs = append(dirs, meta)
+			// writable until the children are created
+			return os.MkdirAll(dst, 0o700)
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		hashes[dst], err = fsys.exportFile(name, dst)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(dst, meta.mode.Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, meta.mtime, meta.mtime)
+	})
+	if err != nil {
+		return stats, err
+	}
+	slices.Reverse(dirs)
+	for _, meta := range dirs {
+		dst := filepath.Join(dir, filepath.FromSlash(meta.name))
+		if err := os.Chmod(dst, meta.mode.Perm()); err != nil {
+			return stats, err
+		}
+		if err := os.Chtimes(dst, meta.mtime, meta.mtime); err != nil {
+			return stats, err
+		}
+	}
+	return stats, verifyHashes(hashes, hashHostFile)
+}
+
+// copy a file to the host, returns the hash of the content
+func (fsys *FS) exportFile(name string, dst string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	src := io.NewSectionReader(f, 0, 1<<62)
+	if _, err := io.Copy(io.MultiWriter(fp, h), src); err != nil {
+		return nil, err
+	}
+	if err := fp.Sync(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), fp.Close()
+}
@@ -0,0 +1,154 @@
+package fsys
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type hostFile struct {
+	mode  fs.FileMode
+	mtime time.Time
+	data  []byte
+}
+
+// the files and directories under a host directory
+func walkHost(t *testing.T, dir string) map[string]hostFile {
+	t.Helper()
+	files := map[string]hostFile{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsDir() && !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, name)
+		file := hostFile{mode: info.Mode(), mtime: info.ModTime()}
+		if info.Mode().IsRegular() {
+			if file.data, err = os.ReadFile(name); err != nil {
+				return err
+			}
+		}
+		files[filepath.ToSlash(rel)] = file
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestImportExport(t *testing.T) {
+	src := t.TempDir()
+	// a file that spans several import chunks, and small files in batches
+	big := make([]byte, 2*IMPORT_BATCH_BYTES+1234)
+	for i := range big {
+		big[i] = byte(i * 7 / 3)
+	}
+	files := map[string][]byte{
+		"big":           big,
+		"empty":         nil,
+		"a/one.txt":     []byte("one"),
+		"a/b/two.txt":   bytes.Repeat([]byte("two"), BLOCK_SIZE),
+		"a/b/c/three":   []byte("three"),
+		"d/run.sh":      []byte("#!/bin/sh\n"),
+		"d/private.key": []byte("secret"),
+	}
+	modes := map[string]fs.FileMode{"d/run.sh": 0o755, "d/private.key": 0o600, "a/b": 0o700}
+	if err := os.MkdirAll(filepath.Join(src, "a/b/c"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "d/empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("big", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range modes {
+		if err := os.Chmod(filepath.Join(src, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// distinct mtimes in the past, the directories after their children
+	mtime := time.Date(2021, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	for i, name := range []string{"big", "empty", "a/one.txt", "a/b/two.txt", "a/b/c/three",
+		"d/run.sh", "d/private.key", "a/b/c", "a/b", "a", "d/empty", "d", "."} {
+		when := mtime.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(src, name), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := walkHost(t, src)
+
+	fsys := newFS(t)
+	stats, err := fsys.Import(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != len(files) || stats.Dirs != 6 || len(stats.Skipped) != 1 || stats.Skipped[0] != "link" {
+		t.Fatalf("import stats %+v", stats)
+	}
+	dst := t.TempDir()
+	if stats, err = fsys.Export(dst); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != len(files) || stats.Dirs != 6 || stats.Bytes != int64(len(big)+3+3*BLOCK_SIZE+5+10+6) {
+		t.Fatalf("export stats %+v", stats)
+	}
+	got := walkHost(t, dst)
+	if len(got) != len(want) {
+		t.Fatalf("exported %d paths, want %d", len(got), len(want))
+	}
+	for name, w := range want {
+		g, ok := got[name]
+		switch {
+		case !ok:
+			t.Fatalf("%s: not exported", name)
+		case g.mode != w.mode:
+			t.Fatalf("%s: mode %v, want %v", name, g.mode, w.mode)
+		case !g.mtime.Equal(w.mtime):
+			t.Fatalf("%s: mtime %v, want %v", name, g.mtime, w.mtime)
+		case !bytes.Equal(g.data, w.data):
+			t.Fatalf("%s: content differs", name)
+		}
+	}
+}
+
+func TestImportVerify(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := newFS(t)
+	if _, err := fsys.Import(src); err != nil {
+		t.Fatal(err)
+	}
+	want, err := hashHostFile(filepath.Join(src, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[string][]byte{"f": want}
+	if err := verifyHashes(hashes, fsys.hashFile); err != nil {
+		t.Fatal(err)
+	}
+	// the content changed after the copy
+	f, err := fsys.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, f, []byte("H"), 0)
+	if err := verifyHashes(hashes, fsys.hashFile); !errors.Is(err, ErrVerify) {
+		t.Fatalf("verify a changed file: %v", err)
+	}
+}
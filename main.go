@@ -1,15 +1,351 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 
 	"dbfs/btree"
+	"dbfs/fsys"
 )
 
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":  {"backup [-since gen] <db> <file|->", cmdBackup},
+	"restore": {"restore <full|-> [incremental...] <db>", cmdRestore},
+	"import":  {"import <dir> <db>", cmdImport},
+	"export":  {"export <db> <dir>", cmdExport},
+	"stat":    {"stat <db>", cmdStat},
+	"dump":    {"dump [-dot] <db> [page...]", cmdDump},
+	"rotate":  {"rotate [-decrypt] <db> [new-key-file]", cmdRotate},
+}
+
+var errUsage = errors.New("bad arguments")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		fmt.Fprintln(os.Stderr, "  dbfs", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "the key of an encrypted db is read in hex from the file at $DBFS_KEY_FILE")
+	os.Exit(2)
+}
+
 func main() {
-	fmt.Println("Creating new tree...")
-	myTree:=btree.NewC()
-	myTree.Add("0", "Aviral hereee")
-	myTree.Add("1", "whyyy")
-	fmt.Printf("Tree created: %+v\n", myTree)
-}
\ No newline at end of file
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	err := cmd.run(os.Args[2:])
+	if err == errUsage {
+		fmt.Fprintln(os.Stderr, "usage: dbfs", cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbfs:", err)
+		os.Exit(1)
+	}
+}
+
+func openDB(file string) (*btree.KV, error) {
+	key, err := envKey()
+	if err != nil {
+		return nil, err
+	}
+	db := &btree.KV{Path: file, Key: key}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// the key in $DBFS_KEY_FILE, nil if it is not set
+func envKey() ([]byte, error) {
+	if file := os.Getenv("DBFS_KEY_FILE"); file != "" {
+		return loadKey(file)
+	}
+	return nil, nil
+}
+
+// a key file holds the key in hex
+func loadKey(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", file, err)
+	}
+	return key, nil
+}
+
+func cmdBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	since := flags.Uint64("since", 0, "only include pages written after this generation")
+	if flags.Parse(args) != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	args = flags.Args()
+	db, err := openDB(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := io.Writer(os.Stdout)
+	if args[1] != "-" {
+		fp, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		out = fp
+	}
+	snap := db.Snapshot()
+	err = snap.BackupSince(out, *since)
+	if rerr := snap.Release(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backup at generation %d\n", snap.Gen())
+	if fp, ok := out.(*os.File); ok && fp != os.Stdout {
+		return fp.Sync()
+	}
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	chain := []io.Reader{}
+	for _, name := range args[:len(args)-1] {
+		if name == "-" {
+			chain = append(chain, os.Stdin)
+			continue
+		}
+		fp, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		chain = append(chain, fp)
+	}
+	return btree.Restore(chain[0], args[len(args)-1], chain[1:]...)
+}
+
+func openFS(file string) (*btree.KV, *fsys.FS, error) {
+	db, err := openDB(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := fsys.New(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, fs, nil
+}
+
+func printTransfer(stats fsys.TransferStats) {
+	for _, name := range stats.Skipped {
+		fmt.Fprintln(os.Stderr, "skipped:", name)
+	}
+	fmt.Fprintf(os.Stderr, "%d dirs, %d files, %d bytes, verified\n",
+		stats.Dirs, stats.Files, stats.Bytes)
+}
+
+func cmdImport(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	db, fs, err := openFS(args[1])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stats, err := fs.Import(args[0])
+	if err != nil {
+		return err
+	}
+	printTransfer(stats)
+	return nil
+}
+
+func cmdExport(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	db, fs, err := openFS(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stats, err := fs.Export(args[1])
+	if err != nil {
+		return err
+	}
+	printTransfer(stats)
+	return nil
+}
+
+func cmdStat(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	db, err := openDB(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stats, err := db.TreeStats()
+	if err != nil {
+		return err
+	}
+	page := uint64(btree.BTREE_PAGE_SIZE)
+	fmt.Printf("file: %d bytes, %d pages used (%d bytes)\n",
+		stats.FileSize, stats.FilePages, stats.FilePages*page)
+	fmt.Printf("pages: 1 meta, %d tree, %d free list nodes, %d free in %d runs, %d held by snapshots\n",
+		stats.TreePages(), stats.FreeListPages, stats.FreePages, stats.FreeRuns, stats.HeldPages)
+	live, percent := stats.LiveBytes(), 0.0
+	if stats.FilePages > 0 {
+		percent = 100 * float64(live) / float64(stats.FilePages*page)
+	}
+	fmt.Printf("live data: %d bytes, %.1f%% of the used pages\n", live, percent)
+	printShape("tree", stats.Tree)
+	printShape("change log", stats.Log)
+	printShape("catalog", stats.Catalog)
+	for _, b := range stats.Buckets {
+		printShape(fmt.Sprintf("bucket %q", b.Path), b.TreeShape)
+	}
+	return nil
+}
+
+func printShape(name string, shape btree.TreeShape) {
+	if shape.Height == 0 {
+		fmt.Printf("%s: empty\n", name)
+		return
+	}
+	where := fmt.Sprintf("%d internal, %d leaf pages", shape.Internal, shape.Leaves)
+	if shape.Inline {
+		where = "inline"
+	}
+	fmt.Printf("%s: height %d, %s, %d keys\n", name, shape.Height, where, shape.Keys.N)
+	for i, level := range shape.Levels {
+		if shape.Inline {
+			break // no pages
+		}
+		fmt.Printf("  level %d: %d pages, %d keys, %.1f%% full\n",
+			i, level.Pages, level.Keys, 100*level.Fill())
+	}
+	printSizes("key", shape.Keys)
+	printSizes("value", shape.Vals)
+	if shape.Compressed > 0 {
+		fmt.Printf("  %d values compressed, %d bytes stored, ratio %.2f\n",
+			shape.Compressed, shape.StoredBytes, shape.CompressionRatio())
+	}
+}
+
+func printSizes(name string, dist btree.SizeDist) {
+	if dist.N == 0 {
+		return
+	}
+	fmt.Printf("  %s sizes: mean %.1f, max %d\n", name, dist.Mean(), dist.Max)
+	for i, n := range dist.Counts {
+		if n == 0 {
+			continue
+		}
+		lo, hi := 0, 1
+		if i > 0 {
+			lo, hi = 1<<(i-1), 1<<i
+		}
+		fmt.Printf("    [%d, %d): %d\n", lo, hi, n)
+	}
+}
+
+func cmdDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	dot := flags.Bool("dot", false, "render the trees as Graphviz DOT")
+	if flags.Parse(args) != nil || flags.NArg() < 1 || (*dot && flags.NArg() > 1) {
+		return errUsage
+	}
+	args = flags.Args()
+	db, err := openDB(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *dot {
+		return db.WriteDOT(os.Stdout)
+	}
+	pages := []uint64{}
+	for _, arg := range args[1:] {
+		ptr, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		pages = append(pages, ptr)
+	}
+	if len(pages) == 0 { // all pages
+		for ptr := uint64(0); ptr < db.NumPages(); ptr++ {
+			pages = append(pages, ptr)
+		}
+	}
+	for _, ptr := range pages {
+		err := db.DumpPage(os.Stdout, ptr)
+		if errors.Is(err, btree.ErrPageAuth) && len(args) == 1 {
+			// free pages are not necessarily encrypted
+			fmt.Printf("page %d: not decrypted\n", ptr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdRotate(args []string) error {
+	flags := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	decrypt := flags.Bool("decrypt", false, "remove the encryption")
+	if flags.Parse(args) != nil {
+		return errUsage
+	}
+	if nargs := flags.NArg(); (*decrypt && nargs != 1) || (!*decrypt && nargs != 2) {
+		return errUsage
+	}
+	args = flags.Args()
+	oldKey, err := envKey()
+	if err != nil {
+		return err
+	}
+	var newKey []byte
+	if !*decrypt {
+		if newKey, err = loadKey(args[1]); err != nil {
+			return err
+		}
+	}
+	if err := btree.RotateKey(args[0], oldKey, newKey); err != nil {
+		return err
+	}
+	if newKey != nil {
+		fmt.Fprintf(os.Stderr, "encrypted with key %#x\n", btree.KeyID(newKey))
+	}
+	return nil
+}